@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert is an active severe weather alert for a station's area.
+type Alert struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Severity    string    `json:"severity"`
+	Issued      time.Time `json:"issued"`
+	Expires     time.Time `json:"expires"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// alertSeverities are the severities alerts are counted by.
+var alertSeverities = []string{"warning", "watch", "advisory", "statement", "unknown"}
+
+var alertsActive = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "weather_alerts_active",
+		Help: "Number of active severe weather alerts, by severity",
+	},
+	[]string{"station", "severity"},
+)
+
+func init() {
+	prometheus.MustRegister(alertsActive)
+}
+
+// alerter is implemented by providers that can also fetch weather alerts.
+type alerter interface {
+	Alerts(ctx context.Context, stationID string) ([]Alert, error)
+}
+
+// alertUpdater fetches the active alerts of a station every
+// opts.alertsInterval until ctx is cancelled. The active alerts are
+// published retained to .../alerts, and each alert is published once to
+// .../alerts/new when it first appears.
+func alertUpdater(ctx context.Context, logger *slog.Logger, stationID string, a alerter, opts updaterOptions, pub Publisher) {
+	seen := map[string]bool{}
+	for {
+		logger.Debug("Fetching alerts")
+		if alerts, err := a.Alerts(ctx, stationID); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Alerts fetch failed", "err", err)
+		} else {
+			seen = publishAlerts(logger, pub, stationID, alerts, seen, opts)
+		}
+		if !sleepOn(ctx, opts.timeSource(), opts.alertsInterval) {
+			return
+		}
+	}
+}
+
+// publishAlerts publishes the active alerts, announcing those not in seen,
+// and returns the IDs of the active alerts.
+func publishAlerts(logger *slog.Logger, pub Publisher, stationID string, alerts []Alert, seen map[string]bool, opts updaterOptions) map[string]bool {
+	active := map[string]bool{}
+	counts := map[string]int{}
+	for _, alert := range alerts {
+		active[alert.ID] = true
+		counts[alert.Severity]++
+		if seen[alert.ID] {
+			continue
+		}
+		logger.Info("New weather alert", "type", alert.Type, "severity", alert.Severity, "expires", alert.Expires)
+		if payload, err := json.Marshal(alert); err != nil {
+			logger.Error("Failed to encode alert", "err", err)
+		} else {
+			qos, _ := opts.publishFlags("alerts/new", opts.qos, false)
+			pub.Publish(opts.topics.topic(stationID, "alerts/new"), qos, false, payload)
+		}
+	}
+	for _, severity := range alertSeverities {
+		alertsActive.WithLabelValues(stationID, severity).Set(float64(counts[severity]))
+	}
+
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+	payload, err := json.Marshal(alerts)
+	if err != nil {
+		logger.Error("Failed to encode alerts", "err", err)
+		return active
+	}
+	qos, retain := opts.publishFlags("alerts", opts.qos, true)
+	pub.Publish(opts.topics.topic(stationID, "alerts"), qos, retain, payload)
+	return active
+}
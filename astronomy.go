@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// stationLocation is the latest position reported by a station, passed from
+// its updater to its astronomyUpdater.
+type stationLocation struct {
+	mu       sync.Mutex
+	lat, lon float64
+	known    bool
+	changed  chan struct{}
+}
+
+func newStationLocation() *stationLocation {
+	return &stationLocation{changed: make(chan struct{}, 1)}
+}
+
+// set records the station's position, signalling changed if it moved.
+func (l *stationLocation) set(lat float64, lon float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.known && l.lat == lat && l.lon == lon {
+		return
+	}
+	l.lat, l.lon, l.known = lat, lon, true
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (l *stationLocation) get() (float64, float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lat, l.lon, l.known
+}
+
+// astronomyUpdater publishes the sunrise, sunset, day length and moon phase
+// of a station every day, and whether the sun is above the horizon as it
+// changes, until ctx is cancelled. Nothing is published until the station's
+// position is known, from its configuration or its observations.
+func astronomyUpdater(ctx context.Context, logger *slog.Logger, stationID string, loc *stationLocation, opts updaterOptions, pub Publisher) {
+	clk := opts.timeSource()
+	var published, above string
+	for {
+		var wake <-chan time.Time
+		stop := func() bool { return false }
+		if lat, lon, ok := loc.get(); ok {
+			now := clk.now().In(opts.timeLocation())
+			if key := fmt.Sprintf("%s %v %v", now.Format("2006-01-02"), lat, lon); key != published {
+				logger.Debug("Publishing astronomy", "latitude", lat, "longitude", lon)
+				publishAstronomy(logger, pub, stationID, astronomyOn(now, lat, lon), opts)
+				published = key
+			}
+			up, next := sunAboveHorizon(now, lat, lon)
+			if state := fmt.Sprint(up); state != above {
+				qos, retain := opts.publishFlags("sun_above_horizon", opts.qos, opts.retain)
+				pub.Publish(opts.topics.topic(stationID, "sun_above_horizon"), qos, retain, state)
+				above = state
+			}
+			y, m, d := now.Date()
+			if midnight := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()); midnight.Before(next) {
+				next = midnight
+			}
+			wake, stop = clk.timer(next.Sub(now) + time.Second)
+		}
+		select {
+		case <-ctx.Done():
+		case <-loc.changed:
+		case <-wake:
+		}
+		stop()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// astronomy is what's published about a day.
+type astronomy struct {
+	Sunrise          *time.Time `json:"sunrise,omitempty"`
+	Sunset           *time.Time `json:"sunset,omitempty"`
+	DayLengthSeconds int64      `json:"day_length_seconds"`
+	MoonPhase        string     `json:"moon_phase"`
+	MoonIllumination float64    `json:"moon_illumination_percent"`
+	MoonAgeDays      float64    `json:"moon_age_days"`
+}
+
+// astronomyOn returns the astronomy at lat, lon of the day of t, in the
+// location of t.
+func astronomyOn(t time.Time, lat float64, lon float64) astronomy {
+	y, m, d := t.Date()
+	noon := time.Date(y, m, d, 12, 0, 0, 0, t.Location())
+	var a astronomy
+	rise, set, polar := sunTimes(solarCycle(noon, lon), lat, lon)
+	switch polar {
+	case 1:
+		a.DayLengthSeconds = 24 * 60 * 60
+	case 0:
+		rise, set = rise.UTC().Round(time.Second), set.UTC().Round(time.Second)
+		a.Sunrise, a.Sunset = &rise, &set
+		a.DayLengthSeconds = int64(set.Sub(rise) / time.Second)
+	}
+	age, illumination, phase := moonPhase(noon)
+	a.MoonAgeDays = math.Round(age*10) / 10
+	a.MoonIllumination = math.Round(illumination)
+	a.MoonPhase = phase
+	return a
+}
+
+// publishAstronomy publishes each value of a to .../astronomy/<property>,
+// and all of them as JSON to .../astronomy.
+func publishAstronomy(logger *slog.Logger, pub Publisher, stationID string, a astronomy, opts updaterOptions) {
+	qos, retain := opts.publishFlags("astronomy", opts.qos, opts.retain)
+	if opts.publishProperties {
+		values := map[string]string{
+			"day_length_seconds":        fmt.Sprint(a.DayLengthSeconds),
+			"moon_phase":                a.MoonPhase,
+			"moon_illumination_percent": fmt.Sprint(a.MoonIllumination),
+			"moon_age_days":             fmt.Sprint(a.MoonAgeDays),
+			// Cleared during polar day and night.
+			"sunrise": "",
+			"sunset":  "",
+		}
+		if a.Sunrise != nil {
+			values["sunrise"] = a.Sunrise.Format(time.RFC3339)
+			values["sunset"] = a.Sunset.Format(time.RFC3339)
+		}
+		for property, value := range values {
+			pub.Publish(opts.topics.topic(stationID, "astronomy/"+property), qos, retain, value)
+		}
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		logger.Error("Failed to encode astronomy", "err", err)
+		return
+	}
+	pub.Publish(opts.topics.topic(stationID, "astronomy"), qos, retain, payload)
+}
+
+const j2000 = 2451545.0
+
+func julianDate(t time.Time) float64 {
+	return float64(t.Unix())/86400 + 2440587.5
+}
+
+func fromJulianDate(jd float64) time.Time {
+	return time.Unix(0, int64((jd-2440587.5)*86400*float64(time.Second)))
+}
+
+// solarCycle returns the number of the solar day whose noon at longitude lon
+// is closest to t.
+func solarCycle(t time.Time, lon float64) float64 {
+	return math.Round(julianDate(t) - j2000 + lon/360)
+}
+
+// sunTimes returns the sunrise and sunset of solar day n at lat, lon, using
+// the sunrise equation. polar is 1 if the sun doesn't set that day, and -1
+// if it doesn't rise.
+func sunTimes(n float64, lat float64, lon float64) (rise time.Time, set time.Time, polar int) {
+	rad := math.Pi / 180
+	meanNoon := n - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360) * rad
+	center := 1.9148*math.Sin(anomaly) + 0.02*math.Sin(2*anomaly) + 0.0003*math.Sin(3*anomaly)
+	ecliptic := math.Mod(anomaly/rad+center+180+102.9372, 360) * rad
+	transit := j2000 + meanNoon + 0.0053*math.Sin(anomaly) - 0.0069*math.Sin(2*ecliptic)
+	declination := math.Asin(math.Sin(ecliptic) * math.Sin(23.4397*rad))
+	// -0.833° allows for refraction and the size of the sun's disc.
+	cosHourAngle := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*math.Sin(declination)) / (math.Cos(lat*rad) * math.Cos(declination))
+	switch {
+	case cosHourAngle < -1:
+		return time.Time{}, time.Time{}, 1
+	case cosHourAngle > 1:
+		return time.Time{}, time.Time{}, -1
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+	return fromJulianDate(transit - hourAngle/360), fromJulianDate(transit + hourAngle/360), 0
+}
+
+// sunAboveHorizon reports whether the sun is up at t at lat, lon, and when
+// that next changes, or is next worth checking during polar day and night.
+func sunAboveHorizon(t time.Time, lat float64, lon float64) (bool, time.Time) {
+	n := solarCycle(t, lon)
+	// Without a sunrise or sunset before t, it's polar day or night.
+	_, _, polar := sunTimes(n, lat, lon)
+	up := polar == 1
+	next := t.Add(time.Hour)
+	var last time.Time
+	for _, day := range []float64{n - 1, n, n + 1} {
+		rise, set, polar := sunTimes(day, lat, lon)
+		if polar != 0 {
+			continue
+		}
+		for _, e := range []struct {
+			at   time.Time
+			rise bool
+		}{{rise, true}, {set, false}} {
+			if !e.at.After(t) {
+				if e.at.After(last) {
+					last, up = e.at, e.rise
+				}
+			} else if e.at.Before(next) {
+				next = e.at
+			}
+		}
+	}
+	return up, next
+}
+
+// synodicMonth is the mean time from one new moon to the next, in days.
+const synodicMonth = 29.530588853
+
+// moonPhase returns the age of the moon in days at t, the illuminated part
+// of it in percent, and the name of its phase.
+func moonPhase(t time.Time) (float64, float64, string) {
+	// Counted from the new moon of 6 January 2000.
+	age := math.Mod(julianDate(t)-2451550.1, synodicMonth)
+	if age < 0 {
+		age += synodicMonth
+	}
+	fraction := age / synodicMonth
+	illumination := (1 - math.Cos(2*math.Pi*fraction)) / 2 * 100
+	names := []string{"new_moon", "waxing_crescent", "first_quarter", "waxing_gibbous", "full_moon", "waning_gibbous", "last_quarter", "waning_crescent"}
+	return age, illumination, names[int(math.Floor(fraction*8+0.5))%8]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAstronomyOn(t *testing.T) {
+	location := func(name string) *time.Location {
+		l, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	tokyo, stockholm := location("Asia/Tokyo"), location("Europe/Stockholm")
+	tests := []struct {
+		name            string
+		at              time.Time
+		lat, lon        float64
+		sunrise, sunset time.Time // zero during polar night
+	}{
+		{
+			// Still the 20th in UTC, so the day must be taken in the
+			// station's timezone.
+			name:    "Tokyo, early morning",
+			at:      time.Date(2026, 3, 20, 20, 0, 0, 0, time.UTC).In(tokyo),
+			lat:     35.6762,
+			lon:     139.6503,
+			sunrise: time.Date(2026, 3, 21, 5, 45, 0, 0, tokyo),
+			sunset:  time.Date(2026, 3, 21, 17, 53, 0, 0, tokyo),
+		},
+		{
+			name:    "Stockholm, midsummer",
+			at:      time.Date(2026, 6, 21, 10, 0, 0, 0, stockholm),
+			lat:     59.3293,
+			lon:     18.0686,
+			sunrise: time.Date(2026, 6, 21, 3, 31, 0, 0, stockholm),
+			sunset:  time.Date(2026, 6, 21, 22, 8, 0, 0, stockholm),
+		},
+		{
+			name: "Longyearbyen, polar night",
+			at:   time.Date(2026, 12, 21, 12, 0, 0, 0, time.UTC),
+			lat:  78.2232,
+			lon:  15.6267,
+		},
+	}
+	near := func(got *time.Time, want time.Time) bool {
+		if want.IsZero() {
+			return got == nil
+		}
+		return got != nil && got.Sub(want).Abs() <= 2*time.Minute
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := astronomyOn(tt.at, tt.lat, tt.lon)
+			if !near(a.Sunrise, tt.sunrise) {
+				t.Errorf("sunrise %v, want %v", a.Sunrise, tt.sunrise)
+			}
+			if !near(a.Sunset, tt.sunset) {
+				t.Errorf("sunset %v, want %v", a.Sunset, tt.sunset)
+			}
+			if want := int64(tt.sunset.Sub(tt.sunrise) / time.Second); (a.DayLengthSeconds-want) > 240 || (want-a.DayLengthSeconds) > 240 {
+				t.Errorf("day length %ds, want %ds", a.DayLengthSeconds, want)
+			}
+		})
+	}
+}
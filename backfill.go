@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// historyProvider is implemented by providers that can fetch the past
+// observations of a station, a day at a time.
+type historyProvider interface {
+	History(ctx context.Context, stationID string, day time.Time) ([]Observation, error)
+}
+
+// backfillCallsPerMinute paces the history requests of backfill when
+// -api-calls-per-minute isn't set, as a long backfill would otherwise send
+// them as fast as the API answers.
+const backfillCallsPerMinute = 10
+
+// Where backfill writes observations to.
+const (
+	backfillOutputInflux = "influx"
+	backfillOutputLine   = "line-protocol"
+	backfillOutputCSV    = "csv"
+)
+
+// backfill fetches the observations of st for every day from from to to,
+// and writes them to sink. It returns how many observations were written.
+func backfill(ctx context.Context, st station, from time.Time, to time.Time, sink Sink) (int, error) {
+	p, ok := st.provider.(historyProvider)
+	if !ok {
+		return 0, fmt.Errorf("the %s provider has no history", st.provider.Name())
+	}
+	logger := slog.With("station", st.id)
+	// Observations are only written to sink, with the properties named
+	// and validated as when they are published, and don't touch the gauges
+	// of the live values.
+	opts := st.opts
+	opts.publishProperties, opts.publishJSON, opts.haDiscovery = false, false, false
+	opts.sinks = []Sink{sink}
+	opts.republishInterval = 0
+	obsPub := newObservationPublisher(logger, st.id, opts)
+	obsPub.gauges = false
+	n := 0
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		history, err := p.History(ctx, st.id, day)
+		if err != nil {
+			return n, fmt.Errorf("%s: %v", day.Format("2006-01-02"), err)
+		}
+		for _, obs := range history {
+			if obs.ObservedAt.IsZero() {
+				continue
+			}
+			deriveMissing(&obs)
+			obsPub.publish(ctx, discardPublisher{}, obs, obs.ObservedAt)
+			n++
+		}
+		logger.Info("Backfilled day", "day", day.Format("2006-01-02"), "observations", len(history))
+	}
+	return n, nil
+}
+
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) {}
+
+// lineProtocolSink writes observations as InfluxDB line protocol, such as to
+// a file for influx write.
+type lineProtocolSink struct {
+	w           io.Writer
+	measurement string
+	area        string
+}
+
+func (s *lineProtocolSink) Name() string { return "line-protocol" }
+
+func (s *lineProtocolSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(s.w, influxLine(s.measurement, s.area, stationID, at, values))
+	return err
+}
+
+// csvSink writes observations as CSV, with a column per published property
+// after the station and time.
+type csvSink struct {
+	w       *csv.Writer
+	columns []string
+}
+
+// newCSVSink returns a sink writing the properties of list to w, starting
+// with a header row.
+func newCSVSink(w io.Writer, list []sensor) (*csvSink, error) {
+	s := &csvSink{w: csv.NewWriter(w)}
+	for _, sn := range list {
+		s.columns = append(s.columns, sn.property)
+	}
+	return s, s.w.Write(append([]string{"station", "time"}, s.columns...))
+}
+
+func (s *csvSink) Name() string { return "csv" }
+
+func (s *csvSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	row := []string{stationID, at.UTC().Format(time.RFC3339)}
+	for _, column := range s.columns {
+		if v, ok := values[column]; ok {
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		} else {
+			row = append(row, "")
+		}
+	}
+	s.w.Write(row)
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// newBackfillSink returns the sink of output, writing to file or stdout for
+// those that write a file, and a function to close it with. Its columns or
+// fields are the properties of stations.
+func newBackfillSink(output string, file string, influx *influxSink, measurement string, area string, stations []station) (Sink, func() error, error) {
+	w, closeFile := io.Writer(os.Stdout), func() error { return nil }
+	if file != "" && output != backfillOutputInflux {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closeFile = f, f.Close
+	}
+	switch output {
+	case backfillOutputInflux:
+		if influx == nil {
+			return nil, nil, fmt.Errorf("-output influx requires -influx-url")
+		}
+		return influx, closeFile, nil
+	case backfillOutputLine:
+		return &lineProtocolSink{w, measurement, area}, closeFile, nil
+	case backfillOutputCSV:
+		var list []sensor
+		seen := map[string]bool{}
+		for _, st := range stations {
+			for _, s := range st.opts.sensors() {
+				if !seen[s.property] {
+					seen[s.property] = true
+					list = append(list, s)
+				}
+			}
+		}
+		s, err := newCSVSink(w, list)
+		return s, closeFile, err
+	}
+	closeFile()
+	return nil, nil, fmt.Errorf("unknown output %q, expected influx, line-protocol or csv", output)
+}
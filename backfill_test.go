@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// historyStub serves an observation every six hours of each day.
+type historyStub struct{}
+
+func (historyStub) Name() string { return "stub" }
+
+func (historyStub) Observe(ctx context.Context, stationID string) (Observation, error) {
+	return Observation{StationID: stationID}, nil
+}
+
+func (historyStub) History(ctx context.Context, stationID string, day time.Time) ([]Observation, error) {
+	var history []Observation
+	for hour := 0; hour < 24; hour += 6 {
+		history = append(history, Observation{
+			StationID:   stationID,
+			ObservedAt:  day.Add(time.Duration(hour) * time.Hour),
+			Temperature: valid(float64(hour)),
+		})
+	}
+	return history, nil
+}
+
+func TestBackfill(t *testing.T) {
+	opts := testOptions(t)
+	st := station{id: "KBACKFILL1", provider: historyStub{}, opts: opts}
+	live := temperature.WithLabelValues(st.id, "")
+	live.Set(15)
+
+	var b bytes.Buffer
+	sink, err := newCSVSink(&b, []sensor{{property: "temperature_degrees"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	n, err := backfill(context.Background(), st, from, from.AddDate(0, 0, 1), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 8 {
+		t.Errorf("backfilled %d observations, want 8", n)
+	}
+	want := "station,time,temperature_degrees\n" +
+		"KBACKFILL1,2026-10-01T00:00:00Z,0\n" +
+		"KBACKFILL1,2026-10-01T06:00:00Z,6\n" +
+		"KBACKFILL1,2026-10-01T12:00:00Z,12\n" +
+		"KBACKFILL1,2026-10-01T18:00:00Z,18\n" +
+		"KBACKFILL1,2026-10-02T00:00:00Z,0\n" +
+		"KBACKFILL1,2026-10-02T06:00:00Z,6\n" +
+		"KBACKFILL1,2026-10-02T12:00:00Z,12\n" +
+		"KBACKFILL1,2026-10-02T18:00:00Z,18\n"
+	if got := b.String(); got != want {
+		t.Errorf("wrote\n%s\nwant\n%s", got, want)
+	}
+	if got := testutil.ToFloat64(live); got != 15 {
+		t.Errorf("backfill changed the live temperature gauge to %v", got)
+	}
+	if heartbeat.DeleteLabelValues(st.id) {
+		t.Error("backfill set the heartbeat of the station")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// brokerConfig is an MQTT broker in the config file that observations are
+// published to as well as the one given by the flags. Nothing is inherited
+// from the flags but the client ID and MQTT version.
+type brokerConfig struct {
+	Server        string `yaml:"server"`
+	ClientID      string `yaml:"clientid"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	PasswordFile  string `yaml:"password_file"`
+	CAFile        string `yaml:"ca_file"`
+	ClientCert    string `yaml:"client_cert"`
+	ClientKey     string `yaml:"client_key"`
+	TLSServerName string `yaml:"tls_server_name"`
+	TLSInsecure   bool   `yaml:"tls_insecure"`
+	MQTTVersion   int    `yaml:"mqtt_version"`
+	// TopicPrefix replaces -topic-prefix in the topics published to this
+	// broker.
+	TopicPrefix string `yaml:"topic_prefix"`
+	// QoS replaces the QoS of everything published to this broker.
+	QoS *int `yaml:"qos"`
+	// Format replaces -format for this broker.
+	Format string `yaml:"format"`
+}
+
+// brokerSpec holds the resolved settings of a broker.
+type brokerSpec struct {
+	settings    mqttSettings
+	version     int
+	topicPrefix string
+	qos         *int
+	format      string
+}
+
+func (c brokerConfig) spec(clientID string, version int, format string) (brokerSpec, error) {
+	if c.Server == "" {
+		return brokerSpec{}, fmt.Errorf("no server given")
+	}
+	if c.QoS != nil && (*c.QoS < 0 || *c.QoS > 2) {
+		return brokerSpec{}, fmt.Errorf("%s: qos must be 0, 1 or 2", c.Server)
+	}
+	password, err := resolveSecret(c.Password, c.PasswordFile)
+	if err != nil {
+		return brokerSpec{}, fmt.Errorf("%s: %v", c.Server, err)
+	}
+	tlsConfig, err := newTLSConfig(c.CAFile, c.ClientCert, c.ClientKey, c.TLSServerName, c.TLSInsecure)
+	if err != nil {
+		return brokerSpec{}, fmt.Errorf("%s: %v", c.Server, err)
+	}
+	if c.ClientID != "" {
+		clientID = c.ClientID
+	}
+	if c.MQTTVersion != 0 {
+		version = c.MQTTVersion
+	}
+	if c.Format != "" {
+		if format, err = parseFormat(c.Format); err != nil {
+			return brokerSpec{}, fmt.Errorf("%s: %v", c.Server, err)
+		}
+	}
+	return brokerSpec{
+		settings: mqttSettings{
+			server:   c.Server,
+			clientID: clientID,
+			username: c.Username,
+			password: password,
+			tls:      tlsConfig,
+		},
+		version:     version,
+		topicPrefix: c.TopicPrefix,
+		qos:         c.QoS,
+		format:      format,
+	}, nil
+}
+
+// broker is one of the MQTT brokers that observations are published to, each
+// with its own connection and publish queue.
+type broker struct {
+	server      string
+	conn        mqttConn
+	pub         *publishLimiter
+	topics      *topicTemplate
+	statusTopic string
+	cmdFilter   string
+	qos         *int
+
+	// format is the output format of the broker. Brokers in a format other
+	// than formatTopics get observations from sink instead of the updaters'
+	// publishes.
+	format string
+	sink   Sink
+	// offline is published to statusTopic when shutting down.
+	offline string
+
+	// Topics starting with fromPrefix are published with toPrefix instead.
+	fromPrefix, toPrefix string
+}
+
+// newBroker returns a broker for spec, not yet connected. topics builds the
+// topics published by the updaters, from tmpl with prefix.
+func newBroker(spec brokerSpec, topics *topicTemplate, tmpl string, prefix string, area string) (*broker, error) {
+	b := &broker{server: spec.settings.server, topics: topics, qos: spec.qos, format: spec.format, offline: "offline"}
+	if spec.topicPrefix != "" && strings.TrimSuffix(spec.topicPrefix, "/") != strings.TrimSuffix(prefix, "/") {
+		// Topics are rewritten rather than built again for every broker,
+		// which needs the prefix to lead them.
+		if !strings.HasPrefix(tmpl, "{{.Prefix}}") {
+			return nil, fmt.Errorf("%s: topic_prefix needs a topic template starting with {{.Prefix}}", b.server)
+		}
+		var err error
+		if b.topics, err = newTopicTemplate(tmpl, spec.topicPrefix, area); err != nil {
+			return nil, err
+		}
+		b.fromPrefix, b.toPrefix = topics.prefix, b.topics.prefix
+	}
+	b.statusTopic = b.topics.statusTopic(spec.settings.clientID)
+	return b, nil
+}
+
+func (b *broker) Publish(topic string, qos byte, retained bool, payload interface{}) {
+	b.PublishWithProperties(topic, qos, retained, payload, messageProperties{})
+}
+
+func (b *broker) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props messageProperties) {
+	if b.toPrefix != "" && strings.HasPrefix(topic, b.fromPrefix) {
+		topic = b.toPrefix + strings.TrimPrefix(topic, b.fromPrefix)
+	}
+	if b.qos != nil {
+		qos = byte(*b.qos)
+	}
+	b.pub.PublishWithProperties(topic, qos, retained, payload, props)
+}
+
+// publishDiscovery publishes the discovery configs of a station with the
+// topics of this broker.
+func (b *broker) publishDiscovery(prefix string, st station) {
+	st.opts.topics = b.topics.forStation(st.opts.alias, st.opts.labels, st.opts.area)
+	publishDiscovery(b.pub, prefix, b.statusTopic, st)
+}
+
+// brokers fans publishes out to every broker. As each broker queues its
+// publishes, one that is slow or down doesn't hold up the others.
+type brokers []*broker
+
+func (bs brokers) Publish(topic string, qos byte, retained bool, payload interface{}) {
+	for _, b := range bs {
+		b.Publish(topic, qos, retained, payload)
+	}
+}
+
+func (bs brokers) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props messageProperties) {
+	for _, b := range bs {
+		b.PublishWithProperties(topic, qos, retained, payload, props)
+	}
+}
+
+// topicBrokers returns the brokers that observations are published to as
+// topics by the updaters.
+func (bs brokers) topicBrokers() brokers {
+	var topics brokers
+	for _, b := range bs {
+		if b.format == formatTopics {
+			topics = append(topics, b)
+		}
+	}
+	return topics
+}
+
+// conns returns the connection to each broker, by server.
+func (bs brokers) conns() map[string]mqttConn {
+	conns := map[string]mqttConn{}
+	for _, b := range bs {
+		conns[b.server] = b.conn
+	}
+	return conns
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cachedObservation is the last observation fetched for a station.
+type cachedObservation struct {
+	Observation Observation `json:"observation"`
+	FetchedAt   time.Time   `json:"fetched_at"`
+}
+
+// observationCache keeps the last observation of every station in a JSON
+// file, so that they can be republished right away after a restart instead
+// of after the first fetch.
+type observationCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]cachedObservation
+}
+
+// loadObservationCache reads the cache at path. A missing file is an empty
+// cache.
+func loadObservationCache(path string) (*observationCache, error) {
+	c := &observationCache{path: path, entries: map[string]cachedObservation{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *observationCache) get(stationID string) (cachedObservation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[stationID]
+	return entry, ok
+}
+
+// put records obs as the last observation of stationID, and writes the cache
+// to disk.
+func (c *observationCache) put(stationID string, obs Observation, at time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[stationID] = cachedObservation{obs, at}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so that a crash can't leave
+	// a truncated cache behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Commands of wgd2mqtt, given as the first argument. Without one, run is
+// assumed, so that existing invocations keep working.
+const (
+	commandRun         = "run"
+	commandFetch       = "fetch"
+	commandCheckConfig = "check-config"
+	commandBackfill    = "backfill"
+)
+
+// parseCommand splits the command off args, returning the remaining
+// arguments to parse as flags.
+func parseCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case commandRun, commandFetch, commandCheckConfig, commandBackfill:
+			return args[0], args[1:]
+		}
+	}
+	return commandRun, args
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %[1]s [run] [flags]
+       %[1]s fetch [flags] STATION
+       %[1]s check-config [flags] [FILE]
+       %[1]s backfill -from DATE [-to DATE] [flags]
+
+Commands:
+  run           Publish observations to MQTT (the default)
+  fetch         Fetch a single observation and print it as JSON
+  check-config  Validate the config file and exit
+  backfill      Write the past observations of the stations to -output
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// fetchStationConfig returns the configuration of the station to fetch, which
+// is that in configs if it is configured, so that its provider and API key
+// are used.
+func fetchStationConfig(configs []stationConfig, id string) stationConfig {
+	for _, c := range configs {
+		if c.ID == id {
+			return c
+		}
+	}
+	return stationConfig{ID: id}
+}
+
+// fetchObservation fetches the current observation of st and writes it to
+// stdout as JSON, with the readings derived from it filled in.
+func fetchObservation(ctx context.Context, st station) error {
+	obs, err := st.provider.Observe(ctx, st.id)
+	if err != nil {
+		return err
+	}
+	for field, value := range obs.malformedFields() {
+		slog.Warn("Ignoring unparsable value", "station", st.id, "field", field, "value", value)
+	}
+	deriveMissing(&obs)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(obs)
+}
+
+// dryRunConn stands in for a broker connection with -dry-run, logging what
+// would be published instead of connecting.
+type dryRunConn struct {
+	server string
+}
+
+func (c dryRunConn) publish(req publishRequest) func(timeout time.Duration) error {
+	payload := req.payload
+	if b, ok := payload.([]byte); ok {
+		payload = string(b)
+	}
+	slog.Info("Would publish", "server", c.server, "topic", req.topic, "payload", payload, "qos", req.qos, "retained", req.retained)
+	return func(time.Duration) error { return nil }
+}
+
+func (c dryRunConn) subscribe(filter string, handler func(topic string, payload []byte)) error {
+	slog.Info("Would subscribe", "server", c.server, "filter", filter)
+	return nil
+}
+
+func (c dryRunConn) isConnected() bool { return true }
+
+func (c dryRunConn) disconnect(timeout time.Duration) {}
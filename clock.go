@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock tells the time and schedules the fetches of the updaters. It is the
+// system clock unless another is set in updaterOptions, such as one that is
+// advanced by hand.
+type clock interface {
+	now() time.Time
+	// timer returns a channel that receives once d has passed, and a
+	// function that stops it.
+	timer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) now() time.Time { return time.Now() }
+
+func (systemClock) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// sleep waits for d, returning false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	return sleepOn(ctx, systemClock{}, d)
+}
+
+// sleepOn is sleep, waiting on c.
+func sleepOn(ctx context.Context, c clock, d time.Duration) bool {
+	t, stop := c.timer(d)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t:
+		return true
+	}
+}
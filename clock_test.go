@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(t time.Time) *fakeClock { return &fakeClock{t: t} }
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c.t.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.t
+		return t.c, func() bool { return false }
+	}
+	c.timers = append(c.timers, t)
+	return t.c, func() bool { return c.stop(t) }
+}
+
+func (c *fakeClock) stop(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// advance moves the clock forward by d, firing the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.t) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.t
+		}
+	}
+	c.timers = pending
+}
+
+// waitForTimers waits until n timers are pending, which is when the code
+// being tested is blocked waiting on the clock.
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSleepOn(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	done := make(chan bool)
+	go func() { done <- sleepOn(context.Background(), clk, time.Minute) }()
+	clk.waitForTimers(t, 1)
+	clk.advance(59 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("woke up early")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.advance(time.Second)
+	if !<-done {
+		t.Error("sleep was cancelled")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- sleepOn(ctx, clk, time.Minute) }()
+	clk.waitForTimers(t, 1)
+	cancel()
+	if <-done {
+		t.Error("sleep wasn't cancelled")
+	}
+	clk.waitForTimers(t, 0)
+}
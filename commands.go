@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// commandFilter returns the topic filter matching the refresh command topic
+// of every station, which requires the station ID or alias to be a whole
+// level of -topic-template, and the template not to use station labels.
+func commandFilter(topics *topicTemplate) (string, error) {
+	filter := topics.topic("+", "cmd/refresh")
+	for i, level := range strings.Split(filter, "/") {
+		if strings.Contains(level, "+") && level != "+" {
+			return "", fmt.Errorf("the station ID must be a whole level of the topic template")
+		}
+		if level == "" && i > 0 {
+			return "", fmt.Errorf("station labels can't be used in the topic template with commands")
+		}
+	}
+	return filter, nil
+}
+
+// subscribeCommands subscribes to the refresh command topics, which trigger
+// an immediate fetch of one or all stations. It's called on every (re)connect,
+// as subscriptions don't survive the connection.
+func subscribeCommands(conn mqttConn, topics *topicTemplate, filter string, sup *supervisor) {
+	// Handlers run on the client's goroutine, so they must not block on
+	// the supervisor.
+	refreshAll := func(topic string, payload []byte) {
+		slog.Info("Refresh of all stations requested", "topic", topic)
+		go sup.refreshAll()
+	}
+	refresh := func(topic string, payload []byte) {
+		go func() {
+			if s, ok := refreshedStation(sup.stations(), topics, topic); ok {
+				slog.Info("Refresh requested", "station", s.id, "topic", topic)
+				sup.refresh(s.id)
+				return
+			}
+			slog.Debug("Refresh requested for unknown station", "topic", topic)
+		}()
+	}
+	if err := conn.subscribe(topics.refreshAllTopic(), refreshAll); err != nil {
+		slog.Error("Failed to subscribe to command topic", "topic", topics.refreshAllTopic(), "err", err)
+	}
+	if err := conn.subscribe(filter, refresh); err != nil {
+		slog.Error("Failed to subscribe to command topic", "topic", filter, "err", err)
+	}
+}
+
+// refreshedStation returns the station whose refresh command topic is topic,
+// built from the topics of the broker it was received on, which may have a
+// prefix of its own.
+func refreshedStation(stations []station, topics *topicTemplate, topic string) (station, bool) {
+	for _, s := range stations {
+		if topics.forStation(s.opts.alias, s.opts.labels, s.opts.area).topic(s.id, "cmd/refresh") == topic {
+			return s, true
+		}
+	}
+	return station{}, false
+}
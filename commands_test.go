@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestRefreshedStation(t *testing.T) {
+	defaults, err := newTopicTemplate("{{.Prefix}}/{{.Alias}}/{{.Property}}", "wgd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A broker with a topic_prefix of its own.
+	broker, err := newTopicTemplate("{{.Prefix}}/{{.Alias}}/{{.Property}}", "site", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stations := []station{
+		{id: "KX1", opts: updaterOptions{topics: defaults}},
+		{id: "KX2", alias: "garden", opts: updaterOptions{alias: "garden", topics: defaults.forStation("garden", nil, "")}},
+	}
+	tests := []struct {
+		topics *topicTemplate
+		topic  string
+		want   string
+	}{
+		{defaults, "wgd/KX1/cmd/refresh", "KX1"},
+		{defaults, "wgd/garden/cmd/refresh", "KX2"},
+		{broker, "site/KX1/cmd/refresh", "KX1"},
+		{broker, "site/garden/cmd/refresh", "KX2"},
+		{broker, "wgd/KX1/cmd/refresh", ""},
+		{defaults, "wgd/KX2/cmd/refresh", ""},
+	}
+	for _, tt := range tests {
+		s, ok := refreshedStation(stations, tt.topics, tt.topic)
+		if s.id != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s refreshes %q, want %q", tt.topic, s.id, tt.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is the YAML configuration file. Every setting but stations
+// corresponds to a command line flag, and flags given explicitly take
+// precedence. Stations given with -stations replace the configured ones.
+type config struct {
+	Server            string                    `yaml:"server"`
+	CAFile            string                    `yaml:"ca_file"`
+	ClientCert        string                    `yaml:"client_cert"`
+	ClientKey         string                    `yaml:"client_key"`
+	TLSServerName     string                    `yaml:"tls_server_name"`
+	TLSInsecure       bool                      `yaml:"tls_insecure"`
+	ClientID          string                    `yaml:"clientid"`
+	MQTTVersion       int                       `yaml:"mqtt_version"`
+	Format            string                    `yaml:"format"`
+	MessageExpiry     time.Duration             `yaml:"message_expiry"`
+	PersistentSession bool                      `yaml:"persistent_session"`
+	OfflineBuffer     *int                      `yaml:"offline_buffer"`
+	Brokers           []brokerConfig            `yaml:"brokers"`
+	Webhooks          []webhookConfig           `yaml:"webhooks"`
+	Username          string                    `yaml:"username"`
+	Password          string                    `yaml:"password"`
+	APIKey            string                    `yaml:"apikey"`
+	Provider          string                    `yaml:"provider"`
+	ListenPWS         string                    `yaml:"listen_pws"`
+	ListenTempest     string                    `yaml:"listen_tempest"`
+	Location          string                    `yaml:"location"`
+	Commands          bool                      `yaml:"commands"`
+	Geolookup         string                    `yaml:"geolookup"`
+	GeolookupCount    int                       `yaml:"geolookup_count"`
+	GeolookupInterval time.Duration             `yaml:"geolookup_interval"`
+	Stations          []stationConfig           `yaml:"stations"`
+	QoS               *int                      `yaml:"qos"`
+	Retain            *bool                     `yaml:"retain"`
+	Properties        map[string]propertyConfig `yaml:"properties"`
+	Interval          time.Duration             `yaml:"interval"`
+	CacheFile         string                    `yaml:"cache_file"`
+	Astronomy         bool                      `yaml:"astronomy"`
+	DailySummary      bool                      `yaml:"daily_summary"`
+	Jitter            time.Duration             `yaml:"jitter"`
+	HTTPTimeout       time.Duration             `yaml:"http_timeout"`
+	APICallsPerMinute int                       `yaml:"api_calls_per_minute"`
+	APICallsPerDay    int                       `yaml:"api_calls_per_day"`
+	Retries           *int                      `yaml:"retries"`
+	RetryDelay        time.Duration             `yaml:"retry_delay"`
+	RetryMaxDelay     time.Duration             `yaml:"retry_max_delay"`
+	MetricsAddr       string                    `yaml:"metrics_addr"`
+	HTTPListen        string                    `yaml:"http_listen"`
+	HTTPUsername      string                    `yaml:"http_username"`
+	HTTPPassword      string                    `yaml:"http_password"`
+	HTTPTLSCert       string                    `yaml:"http_tls_cert"`
+	HTTPTLSKey        string                    `yaml:"http_tls_key"`
+	MetricsPath       string                    `yaml:"metrics_path"`
+}
+
+// stationConfig holds the settings of one station in the config file. A
+// station may also be given as just its ID.
+type stationConfig struct {
+	ID    string `yaml:"id"`
+	Alias string `yaml:"alias"`
+	// Labels are published with the station attributes, and available to
+	// -topic-template. An area label replaces -area for the station.
+	Labels   map[string]string `yaml:"labels"`
+	Interval time.Duration     `yaml:"interval"`
+	Jitter   time.Duration     `yaml:"jitter"`
+	Provider string            `yaml:"provider"`
+	APIKey   string            `yaml:"apikey"`
+	Units    string            `yaml:"units"`
+	Payload  string            `yaml:"payload"`
+	// Latitude and Longitude replace -location for the station.
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+	// Timezone is the IANA name of the timezone whose midnight starts the
+	// day of the station, such as Europe/Stockholm, instead of TZ.
+	Timezone string `yaml:"timezone"`
+
+	// Members are the stations aggregated by a station with the virtual
+	// provider, using Aggregate, or Aggregates for some readings. Members
+	// not fetched within MaxAge, twice the longest member interval by
+	// default, are left out.
+	Members    []string          `yaml:"members"`
+	Aggregate  string            `yaml:"aggregate"`
+	Aggregates map[string]string `yaml:"aggregates"`
+	MaxAge     time.Duration     `yaml:"max_age"`
+}
+
+// propertyConfig overrides how a property is published, such as
+// temperature_degrees, or state, attributes or availability. Unset fields
+// keep the global -qos and -retain settings.
+type propertyConfig struct {
+	QoS    *int  `yaml:"qos"`
+	Retain *bool `yaml:"retain"`
+	// Deadband is how much a numeric value must change, in the unit of
+	// the property, to be published before -republish-interval.
+	Deadband float64 `yaml:"deadband"`
+	// Min and Max override the plausible range of a numeric property,
+	// and MaxChangePerHour rejects readings that change faster than it.
+	Min              *float64 `yaml:"min"`
+	Max              *float64 `yaml:"max"`
+	MaxChangePerHour float64  `yaml:"max_change_per_hour"`
+	// Disabled leaves the property out of MQTT, the sinks and the
+	// metrics. Name publishes it under another name, which also renames
+	// its Home Assistant sensor and its metric, unless Metric names that.
+	Disabled bool   `yaml:"disabled"`
+	Name     string `yaml:"name"`
+	Metric   string `yaml:"metric"`
+}
+
+func (s *stationConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&s.ID); err == nil {
+		return nil
+	}
+	type plain stationConfig
+	return unmarshal((*plain)(s))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate checks settings that can't be checked when their flag is set.
+func (c *config) validate() error {
+	for name, p := range c.Properties {
+		if p.QoS != nil && (*p.QoS < 0 || *p.QoS > 2) {
+			return fmt.Errorf("properties: %s: qos must be 0, 1 or 2", name)
+		}
+		if p.Deadband < 0 {
+			return fmt.Errorf("properties: %s: deadband must not be negative", name)
+		}
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return fmt.Errorf("properties: %s: min must not be greater than max", name)
+		}
+		if p.MaxChangePerHour < 0 {
+			return fmt.Errorf("properties: %s: max_change_per_hour must not be negative", name)
+		}
+		switch name {
+		case "state", "attributes", "availability":
+			if p.Disabled || p.Name != "" || p.Metric != "" {
+				return fmt.Errorf("properties: %s can't be disabled or renamed", name)
+			}
+		}
+		if strings.ContainsAny(p.Name, "/+#") {
+			return fmt.Errorf("properties: %s: name %q must not contain /, + or #", name, p.Name)
+		}
+		if p.Metric != "" && !metricNamePattern.MatchString(p.Metric) {
+			return fmt.Errorf("properties: %s: metric %q is not a valid metric name", name, p.Metric)
+		}
+		// Without a metric, the name also renames the metric.
+		if p.Metric == "" && p.Name != "" && !metricNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("properties: %s: name %q is not a valid metric name, set metric to name the metric", name, p.Name)
+		}
+	}
+	renamed := map[string]string{}
+	for name, p := range c.Properties {
+		if p.Name == "" {
+			continue
+		}
+		if _, ok := c.Properties[p.Name]; ok || renamed[p.Name] != "" {
+			return fmt.Errorf("properties: %s: name %q is used by another property", name, p.Name)
+		}
+		renamed[p.Name] = name
+	}
+	return nil
+}
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// flagValues returns the settings present in the file, keyed by flag name.
+func (c *config) flagValues() map[string]string {
+	v := map[string]string{}
+	if c.Server != "" {
+		v["server"] = c.Server
+	}
+	if c.CAFile != "" {
+		v["ca-file"] = c.CAFile
+	}
+	if c.ClientCert != "" {
+		v["client-cert"] = c.ClientCert
+	}
+	if c.ClientKey != "" {
+		v["client-key"] = c.ClientKey
+	}
+	if c.TLSServerName != "" {
+		v["tls-server-name"] = c.TLSServerName
+	}
+	if c.TLSInsecure {
+		v["tls-insecure"] = "true"
+	}
+	if c.ClientID != "" {
+		v["clientid"] = c.ClientID
+	}
+	if c.MQTTVersion != 0 {
+		v["mqtt-version"] = strconv.Itoa(c.MQTTVersion)
+	}
+	if c.Format != "" {
+		v["format"] = c.Format
+	}
+	if c.MessageExpiry != 0 {
+		v["message-expiry"] = c.MessageExpiry.String()
+	}
+	if c.PersistentSession {
+		v["persistent-session"] = "true"
+	}
+	if c.OfflineBuffer != nil {
+		v["offline-buffer"] = strconv.Itoa(*c.OfflineBuffer)
+	}
+	if c.Username != "" {
+		v["username"] = c.Username
+	}
+	if c.Password != "" {
+		v["password"] = c.Password
+	}
+	if c.APIKey != "" {
+		v["apikey"] = c.APIKey
+	}
+	if c.Provider != "" {
+		v["provider"] = c.Provider
+	}
+	if c.QoS != nil {
+		v["qos"] = strconv.Itoa(*c.QoS)
+	}
+	if c.Retain != nil {
+		v["retain"] = strconv.FormatBool(*c.Retain)
+	}
+	if c.ListenPWS != "" {
+		v["listen-pws"] = c.ListenPWS
+	}
+	if c.ListenTempest != "" {
+		v["listen-tempest"] = c.ListenTempest
+	}
+	if c.Location != "" {
+		v["location"] = c.Location
+	}
+	if c.Geolookup != "" {
+		v["geolookup"] = c.Geolookup
+	}
+	if c.GeolookupCount != 0 {
+		v["geolookup-count"] = strconv.Itoa(c.GeolookupCount)
+	}
+	if c.GeolookupInterval != 0 {
+		v["geolookup-interval"] = c.GeolookupInterval.String()
+	}
+	if c.Astronomy {
+		v["astronomy"] = "true"
+	}
+	if c.DailySummary {
+		v["daily-summary"] = "true"
+	}
+	if c.CacheFile != "" {
+		v["cache-file"] = c.CacheFile
+	}
+	if c.Commands {
+		v["commands"] = "true"
+	}
+	if c.Interval != 0 {
+		v["interval"] = c.Interval.String()
+	}
+	if c.Jitter != 0 {
+		v["jitter"] = c.Jitter.String()
+	}
+	if c.APICallsPerMinute != 0 {
+		v["api-calls-per-minute"] = strconv.Itoa(c.APICallsPerMinute)
+	}
+	if c.APICallsPerDay != 0 {
+		v["api-calls-per-day"] = strconv.Itoa(c.APICallsPerDay)
+	}
+	if c.HTTPTimeout != 0 {
+		v["http-timeout"] = c.HTTPTimeout.String()
+	}
+	if c.Retries != nil {
+		v["retries"] = strconv.Itoa(*c.Retries)
+	}
+	if c.RetryDelay != 0 {
+		v["retry-delay"] = c.RetryDelay.String()
+	}
+	if c.RetryMaxDelay != 0 {
+		v["retry-max-delay"] = c.RetryMaxDelay.String()
+	}
+	if c.MetricsAddr != "" {
+		v["metrics-addr"] = c.MetricsAddr
+	}
+	if c.HTTPListen != "" {
+		v["http-listen"] = c.HTTPListen
+	}
+	if c.HTTPUsername != "" {
+		v["http-username"] = c.HTTPUsername
+	}
+	if c.HTTPPassword != "" {
+		v["http-password"] = c.HTTPPassword
+	}
+	if c.HTTPTLSCert != "" {
+		v["http-tls-cert"] = c.HTTPTLSCert
+	}
+	if c.HTTPTLSKey != "" {
+		v["http-tls-key"] = c.HTTPTLSKey
+	}
+	if c.MetricsPath != "" {
+		v["metrics-path"] = c.MetricsPath
+	}
+	return v
+}
+
+// applyConfig sets every flag that wasn't given on the command line to its
+// value from the config file.
+func applyConfig(fs *flag.FlagSet, cfg *config) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range cfg.flagValues() {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s in config: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveSecret returns value if non-empty, otherwise the contents of file if
+// given. Failing that, it tries each environment variable in envs, and then
+// the file named by the same variable with a _FILE suffix, as used for Docker
+// and Kubernetes secrets.
+func resolveSecret(value string, file string, envs ...string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		return readSecret(file)
+	}
+	for _, env := range envs {
+		if v := os.Getenv(env); v != "" {
+			return v, nil
+		}
+		if f := os.Getenv(env + "_FILE"); f != "" {
+			return readSecret(f)
+		}
+	}
+	return "", nil
+}
+
+// readSecret returns the contents of file without trailing newline.
+func readSecret(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidateProperties(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties map[string]propertyConfig
+		wantErr    string
+	}{
+		{"renamed", map[string]propertyConfig{"temperature_degrees": {Name: "temp_c"}}, ""},
+		{"renamed with metric", map[string]propertyConfig{"temperature_degrees": {Name: "temp-c", Metric: "temp_c"}}, ""},
+		{"invalid metric", map[string]propertyConfig{"temperature_degrees": {Metric: "temp-c"}}, `metric "temp-c"`},
+		{"name not a metric name", map[string]propertyConfig{"temperature_degrees": {Name: "temp-c"}}, `name "temp-c"`},
+		{"name with a wildcard", map[string]propertyConfig{"temperature_degrees": {Name: "temp+c"}}, "must not contain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&config{Properties: tt.properties}).validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+// Providers report observations in metric units, and these convert them to
+// the other units that can be published.
+
+func identity(v float64) float64 { return v }
+
+func celsiusToFahrenheit(c float64) float64 { return c*9/5 + 32 }
+
+func kphToMph(kph float64) float64 { return kph / 1.609344 }
+
+func msToKph(ms float64) float64 { return ms * 3.6 }
+
+func mmToInches(mm float64) float64 { return mm / 25.4 }
+
+func kmToMiles(km float64) float64 { return km / 1.609344 }
+
+func metersToKm(m float64) float64 { return m / 1000 }
+
+// Local uploads are in imperial units, and converted to metric with these.
+
+func fahrenheitToCelsius(f float64) float64 { return (f - 32) * 5 / 9 }
+
+func mphToKph(mph float64) float64 { return mph * 1.609344 }
+
+func inchesToMm(in float64) float64 { return in * 25.4 }
+
+func milesToKm(mi float64) float64 { return mi * 1.609344 }
+
+func inHgToMb(inHg float64) float64 { return inHg * 33.8639 }
@@ -0,0 +1,79 @@
+package main
+
+import "math"
+
+// deriveMissing fills in the dew point, heat index, wind chill, feels like
+// temperature and absolute humidity of obs from its temperature, humidity and
+// wind speed, unless the provider reported them.
+func deriveMissing(obs *Observation) {
+	t, rh, wind := obs.Temperature, obs.Humidity, obs.WindSpeed
+	if !t.valid {
+		return
+	}
+	if !obs.DewPoint.valid && rh.valid && rh.value > 0 {
+		obs.DewPoint = reading{value: derivedDewPoint(t.value, rh.value), valid: true}
+	}
+	if !obs.HeatIndex.valid && rh.valid {
+		obs.HeatIndex = reading{value: derivedHeatIndex(t.value, rh.value), valid: true}
+	}
+	if !obs.WindChill.valid && wind.valid {
+		obs.WindChill = reading{value: derivedWindChill(t.value, wind.value), valid: true}
+	}
+	if !obs.AbsoluteHumidity.valid && rh.valid {
+		obs.AbsoluteHumidity = reading{value: derivedAbsoluteHumidity(t.value, rh.value), valid: true}
+	}
+	if !obs.FeelsLike.valid {
+		switch {
+		case obs.WindChill.valid && obs.WindChill.value < t.value:
+			obs.FeelsLike = obs.WindChill
+		case obs.HeatIndex.valid && obs.HeatIndex.value > t.value:
+			obs.FeelsLike = obs.HeatIndex
+		default:
+			obs.FeelsLike = t
+		}
+	}
+}
+
+// derivedDewPoint returns the dew point in °C for a temperature in °C and relative
+// humidity in %, using the Magnus formula.
+func derivedDewPoint(c float64, rh float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(rh/100) + a*c/(b+c)
+	return b * gamma / (a - gamma)
+}
+
+// derivedHeatIndex returns the NWS heat index in °C for a temperature in °C and
+// relative humidity in %, using the Rothfusz regression. It is the temperature
+// itself below 26.7°C (80°F), where the regression doesn't apply.
+func derivedHeatIndex(c float64, rh float64) float64 {
+	t := celsiusToFahrenheit(c)
+	if t < 80 {
+		return c
+	}
+	hi := -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+		0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+		0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+	if rh < 13 && t >= 80 && t <= 112 {
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if rh > 85 && t >= 80 && t <= 87 {
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return fahrenheitToCelsius(hi)
+}
+
+// derivedWindChill returns the wind chill in °C for a temperature in °C and wind
+// speed in km/h. It is the temperature itself above 10°C or below 4.8 km/h,
+// where the formula doesn't apply.
+func derivedWindChill(c float64, kph float64) float64 {
+	if c > 10 || kph < 4.8 {
+		return c
+	}
+	v := math.Pow(kph, 0.16)
+	return 13.12 + 0.6215*c - 11.37*v + 0.3965*c*v
+}
+
+// derivedAbsoluteHumidity returns the water vapour density in g/m³ for a
+// temperature in °C and relative humidity in %.
+func derivedAbsoluteHumidity(c float64, rh float64) float64 {
+	return 6.112 * math.Exp(17.67*c/(c+243.5)) * rh * 2.1674 / (273.15 + c)
+}
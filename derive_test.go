@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDerivedDewPoint(t *testing.T) {
+	// Reference values from psychrometric tables over water, to 0.1°C.
+	tests := []struct {
+		c, rh, want float64
+	}{
+		{20, 50, 9.3},
+		{30, 80, 26.2},
+		{-10, 60, -16.3},
+		{10, 100, 10},
+		{35, 100, 35},
+	}
+	for _, tt := range tests {
+		if got := derivedDewPoint(tt.c, tt.rh); math.Abs(got-tt.want) > 0.1 {
+			t.Errorf("dew point at %v°C, %v%% = %.2f, want %v", tt.c, tt.rh, got, tt.want)
+		}
+	}
+}
+
+func TestDerivedHeatIndex(t *testing.T) {
+	// Reference values in °F from the NWS heat index chart, which rounds
+	// to whole degrees.
+	tests := []struct {
+		name      string
+		f, rh     float64
+		want, tol float64
+	}{
+		{"chart", 90, 70, 106, 1},
+		{"chart", 100, 40, 109, 1},
+		{"chart", 90, 40, 91, 1},
+		{"chart", 86, 60, 91, 1},
+		{"high humidity adjustment", 86, 90, 105, 1},
+		// The NWS calculator, as the chart doesn't go this dry.
+		{"low humidity adjustment", 100, 10, 94, 1},
+		{"at 80°F", 80, 40, 80, 1},
+		// Below it, it is the temperature itself.
+		{"below 80°F", 79.9, 100, 79.9, 1e-9},
+		{"cold", 50, 80, 50, 1e-9},
+		{"freezing", 20, 50, 20, 1e-9},
+	}
+	for _, tt := range tests {
+		got := celsiusToFahrenheit(derivedHeatIndex(fahrenheitToCelsius(tt.f), tt.rh))
+		if math.Abs(got-tt.want) > tt.tol {
+			t.Errorf("%s: heat index at %v°F, %v%% = %.1f°F, want %v", tt.name, tt.f, tt.rh, got, tt.want)
+		}
+	}
+}
+
+func TestDerivedWindChill(t *testing.T) {
+	// Reference values in °F and mph from the NWS wind chill chart.
+	tests := []struct {
+		name      string
+		f, mph    float64
+		want, tol float64
+	}{
+		{"chart", 0, 15, -19, 0.5},
+		{"chart", 20, 10, 9, 0.5},
+		{"chart", 30, 5, 25, 0.5},
+		{"chart", -10, 20, -35, 0.5},
+		{"chart", 40, 10, 34, 0.5},
+		// The chart's limits, where the formula still applies.
+		{"at 50°F", 50, 3, 49.7, 0.1},
+		{"at 3 mph", 40, 3, 38.4, 0.5},
+		// Outside them, it is the temperature itself.
+		{"above 50°F", 51, 20, 51, 1e-9},
+		{"below 3 mph", 20, 2.9, 20, 1e-9},
+	}
+	for _, tt := range tests {
+		got := celsiusToFahrenheit(derivedWindChill(fahrenheitToCelsius(tt.f), mphToKph(tt.mph)))
+		if math.Abs(got-tt.want) > tt.tol {
+			t.Errorf("%s: wind chill at %v°F, %v mph = %.2f°F, want %v", tt.name, tt.f, tt.mph, got, tt.want)
+		}
+	}
+}
+
+func TestDerivedAbsoluteHumidity(t *testing.T) {
+	// Reference values of saturated and unsaturated water vapour density
+	// over water, in g/m³.
+	tests := []struct {
+		c, rh, want float64
+	}{
+		{20, 50, 8.65},
+		{30, 100, 30.4},
+		{0, 100, 4.85},
+		{-10, 100, 2.36},
+		{25, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := derivedAbsoluteHumidity(tt.c, tt.rh); math.Abs(got-tt.want) > 0.05 {
+			t.Errorf("absolute humidity at %v°C, %v%% = %.3f, want %v", tt.c, tt.rh, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveMissing(t *testing.T) {
+	t.Run("provider values kept", func(t *testing.T) {
+		obs := Observation{Temperature: valid(30), Humidity: valid(70), DewPoint: valid(20), FeelsLike: valid(31)}
+		deriveMissing(&obs)
+		if obs.DewPoint.value != 20 || obs.FeelsLike.value != 31 {
+			t.Errorf("reported values were replaced: %+v", obs)
+		}
+	})
+	t.Run("no dew point at 0% humidity", func(t *testing.T) {
+		obs := Observation{Temperature: valid(20), Humidity: valid(0)}
+		deriveMissing(&obs)
+		if obs.DewPoint.valid {
+			t.Errorf("dew point derived at 0%% humidity: %v", obs.DewPoint.value)
+		}
+		if !obs.AbsoluteHumidity.valid || obs.AbsoluteHumidity.value != 0 {
+			t.Errorf("absolute humidity = %+v, want 0", obs.AbsoluteHumidity)
+		}
+	})
+	t.Run("dew point at 100% humidity", func(t *testing.T) {
+		obs := Observation{Temperature: valid(15), Humidity: valid(100)}
+		deriveMissing(&obs)
+		if math.Abs(obs.DewPoint.value-15) > 1e-9 {
+			t.Errorf("dew point = %v, want 15", obs.DewPoint.value)
+		}
+	})
+	t.Run("feels like wind chill", func(t *testing.T) {
+		obs := Observation{Temperature: valid(-5), Humidity: valid(80), WindSpeed: valid(30)}
+		deriveMissing(&obs)
+		if obs.FeelsLike != obs.WindChill || obs.FeelsLike.value >= -5 {
+			t.Errorf("feels like %v, wind chill %v", obs.FeelsLike, obs.WindChill)
+		}
+	})
+	t.Run("feels like heat index", func(t *testing.T) {
+		obs := Observation{Temperature: valid(32), Humidity: valid(70), WindSpeed: valid(10)}
+		deriveMissing(&obs)
+		if obs.FeelsLike != obs.HeatIndex || obs.FeelsLike.value <= 32 {
+			t.Errorf("feels like %v, heat index %v", obs.FeelsLike, obs.HeatIndex)
+		}
+	})
+	t.Run("no temperature", func(t *testing.T) {
+		obs := Observation{Humidity: valid(50), WindSpeed: valid(10)}
+		deriveMissing(&obs)
+		if obs.DewPoint.valid || obs.HeatIndex.valid || obs.WindChill.valid || obs.FeelsLike.valid {
+			t.Errorf("values derived without a temperature: %+v", obs)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// discoveryConfig is a Home Assistant MQTT discovery payload for a sensor.
+// See https://www.home-assistant.io/docs/mqtt/discovery/
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	AttributesTopic   string          `json:"json_attributes_topic"`
+	Availability      []availability  `json:"availability"`
+	AvailabilityMode  string          `json:"availability_mode"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+type availability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	// SuggestedArea is the station's area label, if it has one.
+	SuggestedArea string `json:"suggested_area,omitempty"`
+}
+
+// stationAttributes is published to <station>/attributes when discovery is
+// enabled, and shown by Home Assistant as attributes of every sensor.
+type stationAttributes struct {
+	StationID string            `json:"station_id"`
+	Alias     string            `json:"alias,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Latitude  *float64          `json:"latitude,omitempty"`
+	Longitude *float64          `json:"longitude,omitempty"`
+}
+
+type sensor struct {
+	property    string
+	name        string
+	unit        string
+	deviceClass string
+}
+
+// sensors lists the published properties that are announced to Home Assistant.
+// When several unit systems are published, unit dependent sensors are named
+// with their unit so they can be told apart.
+func sensors(us []units) []sensor {
+	var list []sensor
+	for _, u := range us {
+		add := func(property string, name string, unit string, deviceClass string) {
+			if len(us) > 1 {
+				name += " (" + unit + ")"
+			}
+			list = append(list, sensor{property, name, unit, deviceClass})
+		}
+		add(u.temperatureTopic, "Temperature", u.temperatureSymbol, "temperature")
+		add(u.feelsLikeTopic, "Feels like", u.temperatureSymbol, "temperature")
+		add(u.dewPointTopic, "Dew point", u.temperatureSymbol, "temperature")
+		add(u.heatIndexTopic, "Heat index", u.temperatureSymbol, "temperature")
+		add(u.windChillTopic, "Wind chill", u.temperatureSymbol, "temperature")
+		add(u.windSpeedTopic, "Wind speed", u.windSpeedSymbol, "wind_speed")
+		add(u.windGustTopic, "Wind gust", u.windSpeedSymbol, "wind_speed")
+		add(u.precipTopic, "Precipitation today", u.precipSymbol, "precipitation")
+		add(u.precip1hrTopic, "Precipitation last hour", u.precipSymbol, "precipitation")
+		add(u.precipRateTopic, "Rain rate", u.precipRateSymbol, "precipitation_intensity")
+		add(u.precip24hTopic, "Precipitation last 24 hours", u.precipSymbol, "precipitation")
+		add(u.precipTodayTopic, "Precipitation since midnight", u.precipSymbol, "precipitation")
+		add(u.visibilityTopic, "Visibility", u.distanceSymbol, "distance")
+	}
+	return append(list,
+		sensor{"relative_humidity_percent", "Humidity", "%", "humidity"},
+		sensor{"absolute_humidity_gm3", "Absolute humidity", "g/m³", "absolute_humidity"},
+		sensor{"pressure_mb", "Pressure", "mbar", "pressure"},
+		sensor{"wind_degrees", "Wind direction", "°", ""},
+		sensor{"uv_index", "UV index", "UV index", ""},
+		sensor{"solar_radiation_wm2", "Solar radiation", "W/m²", "irradiance"},
+	)
+}
+
+// manufacturers names the source of each provider's observations as the
+// manufacturer of the Home Assistant device.
+var manufacturers = map[string]string{
+	"wunderground":   "Weather Underground",
+	"weathercom":     "The Weather Company",
+	"openweathermap": "OpenWeather",
+	"openmeteo":      "Open-Meteo",
+	"pws":            "Personal weather station",
+	"virtual":        "wgd2mqtt",
+}
+
+// manufacturer returns the device manufacturer of a station using provider.
+func manufacturer(provider string) string {
+	if m, ok := manufacturers[provider]; ok {
+		return m
+	}
+	return provider
+}
+
+// publishDiscovery publishes retained Home Assistant discovery configs to
+// <prefix>/sensor/<station>/<property>/config for every sensor of a station.
+// Sensors are available while both the bridge and the station are online.
+// A renamed property keeps its config topic and unique ID, so that Home
+// Assistant keeps its entity, and only its state topic follows the name.
+func publishDiscovery(pub Publisher, prefix string, statusTopic string, st station) {
+	stationID := st.id
+	device := discoveryDevice{
+		Identifiers:  []string{"wgd2mqtt_" + stationID},
+		Name:         "Weather station " + st.name(),
+		Manufacturer: manufacturer(st.provider.Name()),
+		Model:        "Personal weather station " + stationID,
+
+		SuggestedArea: st.opts.labels["area"],
+	}
+	available := []availability{
+		{statusTopic, "online", "offline"},
+		{st.opts.topics.topic(stationID, "availability"), "online", "stale"},
+	}
+	for _, s := range sensors(st.opts.units) {
+		if !st.opts.enabled(s.property) {
+			// Removes the sensor if it was announced before being
+			// disabled.
+			pub.Publish(discoveryTopic(prefix, stationID, s.property), 0, true, "")
+			continue
+		}
+		payload, err := json.Marshal(discoveryConfig{
+			Name:              s.name,
+			UniqueID:          fmt.Sprintf("wgd2mqtt_%s_%s", stationID, s.property),
+			StateTopic:        st.opts.topics.topic(stationID, st.opts.publishedName(s.property)),
+			AttributesTopic:   st.opts.topics.topic(stationID, "attributes"),
+			Availability:      available,
+			AvailabilityMode:  "all",
+			UnitOfMeasurement: s.unit,
+			DeviceClass:       s.deviceClass,
+			Device:            device,
+		})
+		if err != nil {
+			slog.Error("Failed to encode discovery config", "station", stationID, "property", s.property, "err", err)
+			continue
+		}
+		pub.Publish(discoveryTopic(prefix, stationID, s.property), 0, true, payload)
+	}
+}
+
+// clearDiscovery removes the discovery configs of a station that is no
+// longer configured, so Home Assistant removes its sensors.
+func clearDiscovery(pub Publisher, prefix string, st station) {
+	for _, s := range sensors(st.opts.units) {
+		pub.Publish(discoveryTopic(prefix, st.id, s.property), 0, true, "")
+	}
+}
+
+func discoveryTopic(prefix string, stationID string, property string) string {
+	return fmt.Sprintf("%s/sensor/%s/%s/config", prefix, stationID, property)
+}
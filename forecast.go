@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Forecast is a provider-independent daily forecast, in metric units,
+// starting with today.
+type Forecast struct {
+	Days []ForecastDay
+}
+
+type ForecastDay struct {
+	Date         time.Time
+	Conditions   string
+	High         reading // °C
+	Low          reading // °C
+	PrecipChance reading // %
+	Precip       reading // mm
+}
+
+// forecaster is implemented by providers that can also fetch forecasts.
+type forecaster interface {
+	Forecast(ctx context.Context, stationID string) (Forecast, error)
+}
+
+// forecastUpdater fetches the forecast of a station every
+// opts.forecastInterval until ctx is cancelled.
+func forecastUpdater(ctx context.Context, logger *slog.Logger, stationID string, f forecaster, opts updaterOptions, pub Publisher) {
+	for {
+		logger.Debug("Fetching forecast")
+		if forecast, err := f.Forecast(ctx, stationID); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Forecast fetch failed", "err", err)
+		} else {
+			publishForecast(logger, pub, stationID, forecast, opts)
+		}
+		if !sleepOn(ctx, opts.timeSource(), opts.forecastInterval) {
+			return
+		}
+	}
+}
+
+// publishForecast publishes each day of a forecast to
+// .../forecast/day<n>/<property>, and the whole forecast as JSON to
+// .../forecast.
+func publishForecast(logger *slog.Logger, pub Publisher, stationID string, forecast Forecast, opts updaterOptions) {
+	qos, retain := opts.publishFlags("forecast", opts.qos, opts.retain)
+	var days []map[string]interface{}
+	for i, day := range forecast.Days {
+		values := map[string]interface{}{"date": day.Date.Format("2006-01-02")}
+		if day.Conditions != "" {
+			values["conditions"] = day.Conditions
+		}
+		set := func(property string, r reading, min float64, max float64) {
+			if value, ok := validReading(r, min, max); ok {
+				values[property] = value
+			}
+		}
+		for _, u := range opts.units {
+			set("high_"+u.shortTemperature, day.High.convert(u.convertTemperature), u.minTemperature, u.maxTemperature)
+			set("low_"+u.shortTemperature, day.Low.convert(u.convertTemperature), u.minTemperature, u.maxTemperature)
+			set("qpf_"+u.precipSymbol, day.Precip.convert(u.convertPrecip), 0, math.MaxFloat64)
+		}
+		set("pop_percent", day.PrecipChance, 0, 100)
+		if opts.publishProperties {
+			for property, value := range values {
+				topic := opts.topics.topic(stationID, fmt.Sprintf("forecast/day%d/%s", i, property))
+				pub.Publish(topic, qos, retain, fmt.Sprint(value))
+			}
+		}
+		days = append(days, values)
+	}
+	payload, err := json.Marshal(map[string]interface{}{"days": days})
+	if err != nil {
+		logger.Error("Failed to encode forecast", "err", err)
+		return
+	}
+	pub.Publish(opts.topics.topic(stationID, "forecast"), qos, retain, payload)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats of a broker. Observations are published to one topic per
+// property as set by -topic-template, following the Homie 4.0 convention, or
+// as SenML JSON packs.
+const (
+	formatTopics = "topics"
+	formatHomie  = "homie"
+	formatSenML  = "senml"
+)
+
+func parseFormat(format string) (string, error) {
+	switch format {
+	case "", formatTopics:
+		return formatTopics, nil
+	case formatHomie, formatSenML:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected topics, homie or senml", format)
+}
+
+// propertyInfo returns the published properties with a name and unit, as
+// announced to Home Assistant, by property.
+func propertyInfo(opts updaterOptions) map[string]sensor {
+	info := map[string]sensor{}
+	for _, s := range opts.sensors() {
+		info[s.property] = s
+	}
+	return info
+}
+
+// senmlUnits maps the units of the published properties to the SenML units
+// of RFC 8428 and RFC 8798. Those without one are sent without a unit.
+var senmlUnits = map[string]string{
+	"°C":   "Cel",
+	"%":    "%RH",
+	"km/h": "km/h",
+	"mm":   "mm",
+	"mm/h": "mm/h",
+	"km":   "km",
+	"mbar": "hPa",
+	"°":    "deg",
+	"W/m²": "W/m2",
+}
+
+type senmlRecord struct {
+	BaseName string  `json:"bn,omitempty"`
+	BaseTime float64 `json:"bt,omitempty"`
+	Name     string  `json:"n"`
+	Unit     string  `json:"u,omitempty"`
+	Value    float64 `json:"v"`
+}
+
+// senmlPack encodes an observation as a SenML JSON pack, with a record per
+// property named after the station.
+func senmlPack(stationID string, at time.Time, values map[string]float64, info map[string]sensor) ([]byte, error) {
+	properties := make([]string, 0, len(values))
+	for property := range values {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	pack := make([]senmlRecord, 0, len(properties))
+	for i, property := range properties {
+		r := senmlRecord{Name: property, Unit: senmlUnits[info[property].unit], Value: values[property]}
+		if i == 0 {
+			r.BaseName = "urn:dev:wgd2mqtt:" + stationID + ":"
+			r.BaseTime = float64(at.Unix())
+		}
+		pack = append(pack, r)
+	}
+	return json.Marshal(pack)
+}
+
+// senmlSink publishes every observation as a SenML pack to <station>/senml.
+type senmlSink struct {
+	pub    Publisher
+	topics *topicTemplate
+	info   map[string]sensor
+	qos    byte
+	retain bool
+}
+
+func (s *senmlSink) Name() string { return "senml" }
+
+func (s *senmlSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	payload, err := senmlPack(stationID, at, values, s.info)
+	if err != nil {
+		return err
+	}
+	s.pub.Publish(s.topics.topic(stationID, "senml"), s.qos, s.retain, payload)
+	return nil
+}
+
+// homieSink publishes observations following the Homie 4.0 convention, with
+// the bridge as the device, a node per station and a property per published
+// property: homie/<device>/<station>/<property>. The attributes of a node are
+// published when it is first seen, or its properties change.
+type homieSink struct {
+	pub    Publisher
+	device string
+	name   string
+	info   map[string]sensor
+
+	mu    sync.Mutex
+	nodes map[string]homieNode
+}
+
+// homieNode is a station seen by a homieSink.
+type homieNode struct {
+	stationID  string
+	properties []string
+}
+
+// homieBase is the base topic of the Homie convention.
+const homieBase = "homie"
+
+func newHomieSink(pub Publisher, clientID string, info map[string]sensor) *homieSink {
+	return &homieSink{pub: pub, device: homieID(clientID), name: clientID, info: info, nodes: map[string]homieNode{}}
+}
+
+// homieID turns s into a Homie topic ID, which are lowercase letters, digits
+// and hyphens.
+func homieID(s string) string {
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, s)
+	return strings.Trim(id, "-")
+}
+
+// stateTopic is the topic of the device's lifecycle state, which is also
+// its last will.
+func (s *homieSink) stateTopic() string {
+	return homieBase + "/" + s.device + "/$state"
+}
+
+func (s *homieSink) Name() string { return "homie" }
+
+func (s *homieSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	node := homieID(stationID)
+	properties := make([]string, 0, len(values))
+	for property := range values {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	n := homieNode{stationID, properties}
+	s.mu.Lock()
+	changed := strings.Join(s.nodes[node].properties, ",") != strings.Join(properties, ",")
+	if changed {
+		s.nodes[node] = n
+	}
+	s.mu.Unlock()
+	if changed {
+		// Consumers are told the device is being reconfigured while the
+		// attributes change.
+		s.pub.Publish(s.stateTopic(), 1, true, "init")
+		s.announceNode(node, n)
+		s.publishNodes()
+		s.pub.Publish(s.stateTopic(), 1, true, "ready")
+	}
+	for _, property := range properties {
+		s.pub.Publish(s.topic(node, homieID(property)), 0, true, fmt.Sprint(values[property]))
+	}
+	return nil
+}
+
+// announce publishes the attributes of the device and every node seen so
+// far, which is done on every (re)connect.
+func (s *homieSink) announce() {
+	s.pub.Publish(s.stateTopic(), 1, true, "init")
+	s.pub.Publish(homieBase+"/"+s.device+"/$homie", 1, true, "4.0")
+	s.pub.Publish(homieBase+"/"+s.device+"/$name", 1, true, s.name)
+	s.pub.Publish(homieBase+"/"+s.device+"/$extensions", 1, true, "")
+	s.mu.Lock()
+	nodes := map[string]homieNode{}
+	for id, node := range s.nodes {
+		nodes[id] = node
+	}
+	s.mu.Unlock()
+	for id, node := range nodes {
+		s.announceNode(id, node)
+	}
+	s.publishNodes()
+	s.pub.Publish(s.stateTopic(), 1, true, "ready")
+}
+
+func (s *homieSink) announceNode(node string, n homieNode) {
+	ids := make([]string, len(n.properties))
+	for i, property := range n.properties {
+		ids[i] = homieID(property)
+		name, unit := property, ""
+		if info, ok := s.info[property]; ok {
+			name, unit = info.name, info.unit
+		}
+		s.pub.Publish(s.topic(node, ids[i])+"/$name", 1, true, name)
+		s.pub.Publish(s.topic(node, ids[i])+"/$datatype", 1, true, "float")
+		if unit != "" {
+			s.pub.Publish(s.topic(node, ids[i])+"/$unit", 1, true, unit)
+		}
+	}
+	s.pub.Publish(s.topic(node, "$name"), 1, true, "Weather station "+n.stationID)
+	s.pub.Publish(s.topic(node, "$type"), 1, true, "weather-station")
+	s.pub.Publish(s.topic(node, "$properties"), 1, true, strings.Join(ids, ","))
+}
+
+func (s *homieSink) publishNodes() {
+	s.mu.Lock()
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.mu.Unlock()
+	sort.Strings(nodes)
+	s.pub.Publish(homieBase+"/"+s.device+"/$nodes", 1, true, strings.Join(nodes, ","))
+}
+
+func (s *homieSink) topic(node string, id string) string {
+	return homieBase + "/" + s.device + "/" + node + "/" + id
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// geoArea is the area given with -geolookup.
+type geoArea struct {
+	lat, lon float64
+	// radius is in km, and zero for no limit.
+	radius float64
+}
+
+// parseGeoArea parses "lat,lon[,radius]".
+func parseGeoArea(s string) (geoArea, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return geoArea{}, fmt.Errorf("expected lat,lon[,radius], got %q", s)
+	}
+	var v [3]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return geoArea{}, fmt.Errorf("expected lat,lon[,radius], got %q", s)
+		}
+		v[i] = f
+	}
+	a := geoArea{lat: v[0], lon: v[1], radius: v[2]}
+	if a.lat < -90 || a.lat > 90 || a.lon < -180 || a.lon > 180 {
+		return geoArea{}, fmt.Errorf("%q is not a valid location", s)
+	}
+	if a.radius < 0 {
+		return geoArea{}, fmt.Errorf("radius must not be negative")
+	}
+	return a, nil
+}
+
+// nearbyStation is a station found by a geolookup.
+type nearbyStation struct {
+	id string
+	// distance is in km.
+	distance float64
+}
+
+// geolocator is implemented by providers that can find stations near a
+// location.
+type geolocator interface {
+	Nearby(ctx context.Context, lat float64, lon float64) ([]nearbyStation, error)
+}
+
+// lookupStations returns the count closest stations to area that are within
+// its radius.
+func lookupStations(ctx context.Context, g geolocator, area geoArea, count int) ([]stationConfig, error) {
+	nearby, err := g.Nearby(ctx, area.lat, area.lon)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].distance < nearby[j].distance })
+	var configs []stationConfig
+	var ids []string
+	for _, s := range nearby {
+		if len(configs) == count || (area.radius > 0 && s.distance > area.radius) {
+			break
+		}
+		if !stationIDPattern.MatchString(s.id) {
+			continue
+		}
+		configs = append(configs, stationConfig{ID: s.id})
+		ids = append(ids, s.id)
+	}
+	slog.Info("Looked up nearby stations", "found", len(nearby), "stations", strings.Join(ids, ","))
+	return configs, nil
+}
+
+// mergeStations returns the configured stations followed by the discovered
+// ones. buildStations ignores repeated IDs, so the configured settings of a
+// station win.
+func mergeStations(configured []stationConfig, discovered []stationConfig) []stationConfig {
+	configs := make([]stationConfig, 0, len(configured)+len(discovered))
+	configs = append(configs, configured...)
+	return append(configs, discovered...)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks MQTT connectivity and fetch freshness for the /healthz and
+// /readyz endpoints.
+type health struct {
+	// conns are the connections to the brokers, by server. The bridge is
+	// healthy while connected to any of them.
+	conns map[string]mqttConn
+	// clock tells the time of fetches, and is the system clock unless
+	// replaced before the health is used.
+	clock clock
+
+	mu          sync.Mutex
+	maxAge      time.Duration
+	lastSuccess map[string]time.Time
+	// lastAttempt is when each station was last fetched, successfully or
+	// not, to tell a stalled updater from a failing provider.
+	lastAttempt map[string]time.Time
+}
+
+func newHealth(conns map[string]mqttConn, maxAge time.Duration) *health {
+	return &health{conns: conns, clock: systemClock{}, maxAge: maxAge, lastSuccess: map[string]time.Time{}, lastAttempt: map[string]time.Time{}}
+}
+
+// connected reports whether any broker is connected.
+func (h *health) connected() bool {
+	for _, conn := range h.conns {
+		if conn.isConnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// setMaxAge sets how recently a station must have been fetched for the
+// bridge to be ready.
+func (h *health) setMaxAge(maxAge time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maxAge = maxAge
+}
+
+// forget drops a station that is no longer configured.
+func (h *health) forget(stationID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.lastSuccess, stationID)
+	delete(h.lastAttempt, stationID)
+}
+
+// track adds a station that hasn't been fetched yet.
+func (h *health) track(stationID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.lastSuccess[stationID]; !ok {
+		h.lastSuccess[stationID] = time.Time{}
+		h.lastAttempt[stationID] = h.clock.now()
+	}
+}
+
+// attempted records a fetch attempt for a station.
+func (h *health) attempted(stationID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastAttempt[stationID] = h.clock.now()
+}
+
+// stalled returns a station that hasn't even been attempted to be fetched
+// for twice as long as it should have been fetched within, or "" if there
+// is none.
+func (h *health) stalled() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, t := range h.lastAttempt {
+		if h.clock.now().Sub(t) > 2*h.maxAge {
+			return id
+		}
+	}
+	return ""
+}
+
+// fetched records a successful fetch for a station.
+func (h *health) fetched(stationID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess[stationID] = h.clock.now()
+}
+
+// notReadyReason returns why the bridge isn't ready, or "" if it is.
+func (h *health) notReadyReason() string {
+	if !h.connected() {
+		return "not connected to MQTT server"
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.lastSuccess {
+		if !t.IsZero() && h.clock.now().Sub(t) < h.maxAge {
+			return ""
+		}
+	}
+	return "no station fetched successfully within " + h.maxAge.String()
+}
+
+type healthStatus struct {
+	Status        string                   `json:"status"`
+	Reason        string                   `json:"reason,omitempty"`
+	MQTTConnected bool                     `json:"mqtt_connected"`
+	Brokers       map[string]bool          `json:"brokers"`
+	Stations      map[string]stationHealth `json:"stations"`
+}
+
+type stationHealth struct {
+	LastSuccess *time.Time `json:"last_success"`
+}
+
+// status returns the current health, with status set to "ok" unless reason
+// is given.
+func (h *health) status(reason string) healthStatus {
+	status := healthStatus{Status: "ok", Reason: reason, Brokers: map[string]bool{}, Stations: map[string]stationHealth{}}
+	if reason != "" {
+		status.Status = "unavailable"
+	}
+	for server, conn := range h.conns {
+		status.Brokers[server] = conn.isConnected()
+		status.MQTTConnected = status.MQTTConnected || status.Brokers[server]
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, t := range h.lastSuccess {
+		var s stationHealth
+		if !t.IsZero() {
+			t := t.UTC()
+			s.LastSuccess = &t
+		}
+		status.Stations[id] = s
+	}
+	return status
+}
+
+func writeStatus(w http.ResponseWriter, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Reason != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// serveHealthz reports whether the process is alive and connected to MQTT.
+func (h *health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	var reason string
+	if !h.connected() {
+		reason = "not connected to MQTT server"
+	}
+	writeStatus(w, h.status(reason))
+}
+
+// serveReadyz reports whether observations are being published, that is
+// whether any station was fetched recently.
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, h.status(h.notReadyReason()))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthStalled(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	h := newHealth(nil, 10*time.Minute)
+	h.clock = clk
+	h.track("KX1")
+	h.track("KX2")
+	clk.advance(15 * time.Minute)
+	h.attempted("KX1")
+	clk.advance(10 * time.Minute)
+	if got := h.stalled(); got != "KX2" {
+		t.Errorf("stalled() = %q, want KX2", got)
+	}
+	h.attempted("KX2")
+	if got := h.stalled(); got != "" {
+		t.Errorf("stalled() = %q after attempting every station", got)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	h := newHealth(nil, 10*time.Minute)
+	h.clock = clk
+	h.track("KX1")
+	if got := h.status("").Stations["KX1"].LastSuccess; got != nil {
+		t.Errorf("last success of an unfetched station = %v", got)
+	}
+	h.fetched("KX1")
+	clk.advance(time.Minute)
+	if got := h.status("").Stations["KX1"].LastSuccess; got == nil || !got.Equal(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("last success = %v, want the time of the fetch", got)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	conn := &fakeConn{}
+	h := newHealth(map[string]mqttConn{"tcp://broker:1883": conn}, 10*time.Minute)
+	h.clock = clk
+	h.track("KX1")
+	if got := h.notReadyReason(); got != "not connected to MQTT server" {
+		t.Errorf("notReadyReason() = %q while disconnected", got)
+	}
+	conn.reconnect()
+	if got := h.notReadyReason(); got != "no station fetched successfully within 10m0s" {
+		t.Errorf("notReadyReason() = %q before fetching", got)
+	}
+	h.fetched("KX1")
+	clk.advance(9 * time.Minute)
+	if got := h.notReadyReason(); got != "" {
+		t.Errorf("notReadyReason() = %q after fetching", got)
+	}
+	clk.advance(time.Minute)
+	if got := h.notReadyReason(); got == "" {
+		t.Error("still ready once the fetch is maxAge old")
+	}
+}
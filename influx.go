@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxOptions holds the settings of the InfluxDB sink. A bucket selects
+// the v2 API, authenticated with token; otherwise the v1 API is used with
+// database and an optional username and password.
+type influxOptions struct {
+	url         string
+	measurement string
+	area        string
+	timeout     time.Duration
+
+	database string
+	username string
+	password string
+
+	org    string
+	bucket string
+	token  string
+}
+
+// influxSink writes observations to InfluxDB as line protocol, with one
+// point per observation tagged with the station and area.
+type influxSink struct {
+	httpClient *http.Client
+	writeURL   string
+	opts       influxOptions
+}
+
+func newInfluxSink(opts influxOptions) (*influxSink, error) {
+	base := strings.TrimSuffix(opts.url, "/")
+	var writeURL string
+	switch {
+	case opts.bucket != "":
+		q := url.Values{"org": {opts.org}, "bucket": {opts.bucket}, "precision": {"s"}}
+		writeURL = base + "/api/v2/write?" + q.Encode()
+	case opts.database != "":
+		q := url.Values{"db": {opts.database}, "precision": {"s"}}
+		writeURL = base + "/write?" + q.Encode()
+	default:
+		return nil, fmt.Errorf("either an InfluxDB database (v1) or bucket (v2) is required")
+	}
+	return &influxSink{&http.Client{Timeout: opts.timeout}, writeURL, opts}, nil
+}
+
+func (s *influxSink) Name() string { return "influxdb" }
+
+func (s *influxSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.writeURL, strings.NewReader(s.line(stationID, at, values)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.opts.token != "" {
+		req.Header.Set("Authorization", "Token "+s.opts.token)
+	} else if s.opts.username != "" {
+		req.SetBasicAuth(s.opts.username, s.opts.password)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (s *influxSink) line(stationID string, at time.Time, values map[string]float64) string {
+	return influxLine(s.opts.measurement, s.opts.area, stationID, at, values)
+}
+
+// influxLine formats an observation as an InfluxDB line protocol point.
+func influxLine(measurement string, area string, stationID string, at time.Time, values map[string]float64) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(influxEscape(measurement, ", "))
+	b.WriteString(",station=" + influxEscape(stationID, ",= "))
+	if area != "" {
+		b.WriteString(",area=" + influxEscape(area, ",= "))
+	}
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscape(k, ",= ") + "=" + strconv.FormatFloat(values[k], 'f', -1, 64))
+	}
+	b.WriteString(" " + strconv.FormatInt(at.Unix(), 10) + "\n")
+	return b.String()
+}
+
+// influxEscape backslash-escapes the characters in special.
+func influxEscape(s string, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -1,40 +1,24 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type response struct {
-	CurrentObservation struct {
-		ObservationLocation struct {
-			Latitude  string `json:"latitude"`
-			Longitude string `json:"longitude"`
-		} `json:"observation_location"`
-		StationID         string  `json:"station_id"`
-		TempC             float64 `json:"temp_c"`
-		RelativeHumidity  string  `json:"relative_humidity"`
-		WindDegrees       int32   `json:"wind_degrees"`
-		WindKph           float64 `json:"wind_kph"`
-		FeelsLikeC        string  `json:"feelslike_c"`
-		PrecipTodayMetric string  `json:"precip_today_metric"`
-	} `json:"current_observation"`
-}
-
 var heartbeat = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "wunderground_station_last_updated",
@@ -51,6 +35,30 @@ var temperature = prometheus.NewGaugeVec(
 	[]string{"sensor_name", "area"},
 )
 
+var temperatureFahrenheit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "thermometer_temperature_fahrenheit",
+		Help: "Current temperature of the thermometer.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var dewPoint = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "dewpoint_celsius",
+		Help: "Current dew point in celsius.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var dewPointFahrenheit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "dewpoint_fahrenheit",
+		Help: "Current dew point in fahrenheit.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
 var humidity = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "hygrometer_humidity_percent",
@@ -59,6 +67,14 @@ var humidity = prometheus.NewGaugeVec(
 	[]string{"sensor_name", "area"},
 )
 
+var pressure = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "pressure_mb",
+		Help: "Current barometric pressure in mb.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
 var precipitation = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "precipitation_mm",
@@ -67,6 +83,14 @@ var precipitation = prometheus.NewGaugeVec(
 	[]string{"sensor_name", "area"},
 )
 
+var precipitationInches = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_in",
+		Help: "Today's precipitation in inches.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
 var windDirection = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "wind_direction_degrees",
@@ -83,113 +107,1056 @@ var windSpeed = prometheus.NewGaugeVec(
 	[]string{"sensor_name", "area"},
 )
 
-const area = "wunderground"
+var windSpeedMph = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wind_speed_mph",
+		Help: "Current wind speed in mph",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var windGust = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wind_gust_kph",
+		Help: "Current wind gust speed in kph",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var windGustMph = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wind_gust_mph",
+		Help: "Current wind gust speed in mph",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitation1hr = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_1hr_mm",
+		Help: "Precipitation in the last hour in mm.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitation1hrInches = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_1hr_in",
+		Help: "Precipitation in the last hour in inches.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitationRate = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_rate_mm_per_hour",
+		Help: "Current rain rate in mm per hour.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitationRateInches = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_rate_in_per_hour",
+		Help: "Current rain rate in inches per hour.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitation24h = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_24h_mm",
+		Help: "Precipitation in the last 24 hours in mm.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var precipitation24hInches = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "precipitation_24h_in",
+		Help: "Precipitation in the last 24 hours in inches.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var visibility = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "visibility_km",
+		Help: "Current visibility in km",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var visibilityMiles = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "visibility_mi",
+		Help: "Current visibility in miles",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var uvIndex = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "uv_index",
+		Help: "Current UV index",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var solarRadiation = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "solar_radiation_watts_per_square_meter",
+		Help: "Current solar radiation in W/m²",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var heatIndex = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "heat_index_celsius",
+		Help: "Current heat index in celsius.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var heatIndexFahrenheit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "heat_index_fahrenheit",
+		Help: "Current heat index in fahrenheit.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var windChill = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wind_chill_celsius",
+		Help: "Current wind chill in celsius.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var windChillFahrenheit = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wind_chill_fahrenheit",
+		Help: "Current wind chill in fahrenheit.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+var absoluteHumidity = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "absolute_humidity_grams_per_cubic_meter",
+		Help: "Current absolute humidity in g/m³.",
+	},
+	[]string{"sensor_name", "area"},
+)
+
+// weatherGauges are the gauges labelled with sensor_name and area, which are
+// deleted when a station expires.
+var weatherGauges = []*prometheus.GaugeVec{
+	temperature, temperatureFahrenheit, dewPoint, dewPointFahrenheit,
+	humidity, pressure, precipitation, precipitationInches,
+	windDirection, windSpeed, windSpeedMph, windGust, windGustMph,
+	precipitation1hr, precipitation1hrInches, visibility, visibilityMiles,
+	uvIndex, solarRadiation, heatIndex, heatIndexFahrenheit,
+	windChill, windChillFahrenheit, absoluteHumidity,
+	precipitationRate, precipitationRateInches, precipitation24h, precipitation24hInches,
+}
+
+var publishThrottled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mqtt_publish_throttled_total",
+		Help: "Number of MQTT publishes delayed or dropped by the publish rate limiter",
+	},
+	[]string{"result"},
+)
+
+var fetchTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_fetch_total",
+		Help: "Number of observation fetch attempts, by result",
+	},
+	[]string{"station", "result"},
+)
+
+// legacyFetchTotal and legacyLastSuccess are fetchTotal and lastSuccess under
+// their original names, kept for existing alerts and dashboards.
+var legacyFetchTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wunderground_fetch_total",
+		Help: "Deprecated, use wgd2mqtt_fetch_total. Number of observation fetch attempts, by result",
+	},
+	[]string{"station", "result"},
+)
+
+var fetchDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "wgd2mqtt_fetch_duration_seconds",
+		Help:    "Time taken by observation fetch attempts",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	},
+	[]string{"station"},
+)
+
+var parseErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_field_parse_errors_total",
+		Help: "Number of observation fields the provider gave an unparsable value for",
+	},
+	[]string{"station", "field"},
+)
+
+var staleObservations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_stale_observations_total",
+		Help: "Number of fetched observations not published for being older than -max-observation-age",
+	},
+	[]string{"station"},
+)
+
+var lastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wgd2mqtt_last_successful_fetch_timestamp_seconds",
+		Help: "When an observation was last fetched successfully",
+	},
+	[]string{"station"},
+)
+
+var legacyLastSuccess = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wunderground_last_success_timestamp_seconds",
+		Help: "Deprecated, use wgd2mqtt_last_successful_fetch_timestamp_seconds. When an observation was last fetched successfully",
+	},
+	[]string{"station"},
+)
+
+var offlineBuffered = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "wgd2mqtt_mqtt_offline_buffered_messages",
+		Help: "Number of MQTT publishes buffered until the broker is reachable again",
+	},
+)
+
+var publishErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_mqtt_publish_errors_total",
+		Help: "Number of MQTT publishes that failed or timed out",
+	},
+)
+
+// minInterval is the shortest poll interval accepted, to avoid hammering the
+// API. Local providers may be polled as often as every minLocalInterval.
+const (
+	minInterval      = 1 * time.Minute
+	minLocalInterval = 1 * time.Second
+)
 
 func init() {
 	prometheus.MustRegister(heartbeat)
 	prometheus.MustRegister(temperature)
+	prometheus.MustRegister(temperatureFahrenheit)
+	prometheus.MustRegister(dewPoint)
+	prometheus.MustRegister(dewPointFahrenheit)
 	prometheus.MustRegister(humidity)
+	prometheus.MustRegister(pressure)
 	prometheus.MustRegister(precipitation)
+	prometheus.MustRegister(precipitationInches)
 	prometheus.MustRegister(windDirection)
 	prometheus.MustRegister(windSpeed)
+	prometheus.MustRegister(windSpeedMph)
+	prometheus.MustRegister(windGust)
+	prometheus.MustRegister(windGustMph)
+	prometheus.MustRegister(precipitation1hr)
+	prometheus.MustRegister(precipitation1hrInches)
+	prometheus.MustRegister(precipitationRate)
+	prometheus.MustRegister(precipitationRateInches)
+	prometheus.MustRegister(precipitation24h)
+	prometheus.MustRegister(precipitation24hInches)
+	prometheus.MustRegister(visibility)
+	prometheus.MustRegister(visibilityMiles)
+	prometheus.MustRegister(uvIndex)
+	prometheus.MustRegister(solarRadiation)
+	prometheus.MustRegister(heatIndex)
+	prometheus.MustRegister(heatIndexFahrenheit)
+	prometheus.MustRegister(windChill)
+	prometheus.MustRegister(windChillFahrenheit)
+	prometheus.MustRegister(absoluteHumidity)
+	prometheus.MustRegister(publishThrottled)
+	prometheus.MustRegister(fetchTotal)
+	prometheus.MustRegister(legacyFetchTotal)
+	prometheus.MustRegister(fetchDuration)
+	prometheus.MustRegister(parseErrors)
+	prometheus.MustRegister(staleObservations)
+	prometheus.MustRegister(lastSuccess)
+	prometheus.MustRegister(legacyLastSuccess)
+	prometheus.MustRegister(publishErrors)
+	prometheus.MustRegister(offlineBuffered)
 }
 
-func topic(stationID string, property string) string {
-	return fmt.Sprintf("weather_underground/stations/%s/%s", stationID, property)
-}
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		slog.Info("Signal received, exiting")
+		cancel()
+		<-c
+		fatal("Second signal received, exiting immediately")
+	}()
 
-func updater(apiKey string, stationID string, client MQTT.Client) {
-	t := time.NewTicker(20 * time.Minute)
-	for {
-		fmt.Printf("%s: Fetching latest observation\n", stationID)
-		url := fmt.Sprintf("http://api.wunderground.com/api/%s/conditions/q/pws:%s.json", apiKey, stationID)
+	hostname, _ := os.Hostname()
 
-		res, err := http.Get(url)
-		if err != nil || res.StatusCode != 200 {
-			fmt.Printf("%s: Failed to perform HTTP GET\n", stationID)
-		} else {
-			d := json.NewDecoder(res.Body)
-			var data response
-			if err = d.Decode(&data); err != nil || data.CurrentObservation.StationID != stationID {
-				fmt.Printf("%s: Failed to decode JSON: %v\n", stationID, err)
-			} else {
-				client.Publish(topic(stationID, "latitude"), 0, true, data.CurrentObservation.ObservationLocation.Latitude)
-				client.Publish(topic(stationID, "longitude"), 0, true, data.CurrentObservation.ObservationLocation.Longitude)
-
-				client.Publish(topic(stationID, "temperature_degrees"), 0, true, data.CurrentObservation.TempC)
-				fmt.Printf("%s: %.1f C\n", stationID, data.CurrentObservation.TempC)
-				temperature.WithLabelValues(stationID, area).Set(data.CurrentObservation.TempC)
-
-				if strings.HasSuffix(data.CurrentObservation.RelativeHumidity, "%") {
-					strval := data.CurrentObservation.RelativeHumidity[0 : len(data.CurrentObservation.RelativeHumidity)-1]
-					if value, err := strconv.ParseFloat(strval, 64); err == nil {
-						client.Publish(topic(stationID, "relative_humidity_percent"), 0, true, value)
-						humidity.WithLabelValues(stationID, area).Set(value)
-					}
-				}
+	configFile := flag.String("config", "", "Path to a YAML config file; flags given on the command line take precedence")
+	server := flag.String("server", "tcp://127.0.0.1:1883", "The full url of the MQTT server to connect to ex: tcp://127.0.0.1:1883")
+	caFile := flag.String("ca-file", "", "PEM file with CA certificates to verify the MQTT server against, instead of the system pool")
+	clientCert := flag.String("client-cert", "", "PEM file with a client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM file with the private key for -client-cert")
+	tlsServerName := flag.String("tls-server-name", "", "Server name to send in SNI and verify the MQTT server certificate against, instead of the host in -server")
+	tlsInsecure := flag.Bool("tls-insecure", false, "Skip verification of the MQTT server certificate")
+	mqttVersion := flag.Int("mqtt-version", 3, "MQTT protocol version, 3 for 3.1.1 or 5")
+	format := flag.String("format", formatTopics, "How observations are published to MQTT: topics, one per property; homie, following the Homie 4.0 convention; or senml, as a SenML JSON pack to <station>/senml")
+	messageExpiry := flag.Duration("message-expiry", 0, "With MQTT 5, have the broker drop retained observations after this long, 0 to keep them; should be longer than -interval")
+	clientid := flag.String("clientid", hostname+strconv.Itoa(time.Now().Second()), "A clientid for the connection; defaults to wgd2mqtt-<hostname> with -persistent-session")
+	persistentSession := flag.Bool("persistent-session", false, "Have the MQTT server keep the session across reconnects and restarts, so QoS 1 and 2 publishes in flight aren't lost")
+	offlineBuffer := flag.Int("offline-buffer", 1000, "Number of publishes to keep while the MQTT server is unreachable, sent once it reconnects; 0 to drop them")
+	username := flag.String("username", "", "A username to authenticate to the MQTT server")
+	password := flag.String("password", "", "Password to match username, or set WGD2MQTT_MQTT_PASSWORD or WGD2MQTT_MQTT_PASSWORD_FILE")
+	passwordFile := flag.String("password-file", "", "File containing the MQTT password, used when -password is empty")
+	apiKey := flag.String("apikey", "", "API key, or set WGD2MQTT_API_KEY or WGD2MQTT_API_KEY_FILE")
+	apiKeyFile := flag.String("apikey-file", "", "File containing the API key, used when -apikey is empty")
+	providerName := flag.String("provider", "wunderground", "Weather provider: wunderground, openweathermap, weathercom, openmeteo for the modelled weather at -location without an API key, or pws for stations uploading to -listen-pws or broadcasting to -listen-tempest")
+	listenPWS := flag.String("listen-pws", "", "Address to accept Weather Underground and Ecowitt uploads from local weather stations on, for the pws provider")
+	listenTempest := flag.String("listen-tempest", "", "UDP address to receive WeatherFlow Tempest hub broadcasts on, such as :50222, for the pws provider")
+	apiBaseURL := flag.String("api-base-url", "", "Base URL of the weather API, defaults to the provider's")
+	stationList := flag.String("stations", "", "Comma separated list of stations")
+	location := flag.String("location", "", "lat,lon of stations, unless set for the station in -config; required by the openmeteo provider, and used for astronomy until a station reports its position")
+	geolookup := flag.String("geolookup", "", "Also poll the stations closest to lat,lon[,radius in km], as found by the provider")
+	geolookupCount := flag.Int("geolookup-count", 5, "Number of stations to poll with -geolookup")
+	geolookupInterval := flag.Duration("geolookup-interval", 24*time.Hour, "How often to refresh the stations found with -geolookup")
+	interval := flag.Duration("interval", 20*time.Minute, "How often to poll each station")
+	spreadStart := flag.Bool("spread-start", false, "Delay each station's first fetch by a random part of -interval")
+	jitter := flag.Duration("jitter", 0, "Move each fetch by a random offset of up to plus or minus this much")
+	apiCallsPerMinute := flag.Int("api-calls-per-minute", 0, "Maximum weather API calls per minute across all stations, delaying calls beyond it; 0 for unlimited")
+	apiCallsPerDay := flag.Int("api-calls-per-day", 0, "Maximum weather API calls per day across all stations, skipping fetches beyond it; 0 for unlimited")
+	httpTimeout := flag.Duration("http-timeout", 30*time.Second, "Timeout for requests to the weather API")
+	retries := flag.Int("retries", 3, "Number of times to retry a failed fetch before waiting for the next interval")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "Delay before the first retry of a failed fetch, doubled on each attempt")
+	retryMaxDelay := flag.Duration("retry-max-delay", 2*time.Minute, "Maximum delay between retries of a failed fetch")
+	publishRate := flag.Float64("publish-rate", 0, "Maximum MQTT publishes per second across all stations, 0 for unlimited")
+	publishBuffer := flag.Int("publish-buffer", 100, "Number of publishes to buffer when the publish rate is exceeded")
+	sinkBuffer := flag.Int("sink-buffer", 100, "Number of observations to queue for each output sink, such as InfluxDB or a webhook, before dropping the oldest")
+	// The default can be set from the environment, so that the Docker
+	// HEALTHCHECK probes the same address.
+	defaultListen := ":8080"
+	if v := os.Getenv("WGD2MQTT_HTTP_LISTEN"); v != "" {
+		defaultListen = v
+	}
+	httpListen := flag.String("http-listen", defaultListen, "Address to serve Prometheus metrics and the health endpoints on, by default $WGD2MQTT_HTTP_LISTEN or :8080")
+	metricsAddr := flag.String("metrics-addr", "", "Deprecated: use -http-listen")
+	metricsPath := flag.String("metrics-path", "/metrics", "HTTP path to serve Prometheus metrics on")
+	noHTTP := flag.Bool("no-http", false, "Don't serve Prometheus metrics or the health endpoints")
+	noMetrics := flag.Bool("no-metrics", false, "Deprecated: use -no-http")
+	httpUsername := flag.String("http-username", "", "Require HTTP basic auth with this username for everything but the health endpoints")
+	httpPassword := flag.String("http-password", "", "Password for -http-username, or set WGD2MQTT_HTTP_PASSWORD")
+	httpTLSCert := flag.String("http-tls-cert", "", "PEM certificate file to serve HTTPS with")
+	httpTLSKey := flag.String("http-tls-key", "", "PEM key file for -http-tls-cert")
+	topicPrefix := flag.String("topic-prefix", "weather_underground/stations", "MQTT topic prefix, available as {{.Prefix}} in -topic-template")
+	topicTmpl := flag.String("topic-template", "{{.Prefix}}/{{.StationID}}/{{.Property}}", "Go template for MQTT topics, with {{.Prefix}}, {{.StationID}}, {{.Alias}}, {{.Labels.<name>}}, {{.Property}} and {{.Area}}")
+	area := flag.String("area", "wunderground", "Value of the area label on the Prometheus gauges")
+	unitsName := flag.String("units", "metric", "Units to publish, metric, imperial or both")
+	publishProperties := flag.Bool("publish-properties", true, "Publish each property to its own topic")
+	publishJSON := flag.Bool("publish-json", false, "Publish all properties as one retained JSON object to <station>/state")
+	qos := flag.Int("qos", 0, "MQTT QoS level (0, 1 or 2) for published observations")
+	retain := flag.Bool("retain", true, "Publish observations as retained messages")
+	forecastInterval := flag.Duration("forecast-interval", 0, "How often to fetch forecasts from providers that support them, 0 to not fetch forecasts")
+	alertsInterval := flag.Duration("alerts-interval", 0, "How often to fetch severe weather alerts from providers that support them, 0 to not fetch alerts")
+	cacheFile := flag.String("cache-file", "", "JSON file to keep the last observation of each station in, to republish them right away on restart")
+	astronomy := flag.Bool("astronomy", false, "Publish sunrise, sunset, day length, moon phase and sun_above_horizon, computed from each station's position")
+	dailySummary := flag.Bool("daily-summary", false, "Publish each station's minimum and maximum temperature, average wind, peak gust and total precipitation of the day to <station>/summary/today, and of the day before to <station>/summary/yesterday at midnight, in the station's timezone or TZ")
+	staleTTL := flag.Duration("stale-ttl", 0, "Clear a station's retained topics and gauges when it hasn't been fetched for this long, 0 to keep them")
+	maxObservationAge := flag.Duration("max-observation-age", 0, "Mark a station stale instead of publishing its observation when it was taken longer ago than this, 0 to accept any age")
+	staleAfter := flag.Int("stale-after", 3, "Mark a station stale on its availability topic after this many consecutive failed fetches")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for queued publishes and HTTP requests when shutting down")
+	republishInterval := flag.Duration("republish-interval", time.Hour, "Republish values that are unchanged, or changed by less than their configured deadband, at least this often; 0 to publish every value on every fetch")
+	commands := flag.Bool("commands", false, "Subscribe to <station>/cmd/refresh and <prefix>/cmd/refresh_all to fetch stations on request")
+	haDiscovery := flag.Bool("ha-discovery", false, "Publish Home Assistant MQTT discovery configs for each station")
+	haDiscoveryPrefix := flag.String("ha-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery topic prefix")
+	influxURL := flag.String("influx-url", "", "InfluxDB URL to also write observations to, such as http://localhost:8086")
+	influxDatabase := flag.String("influx-database", "", "InfluxDB v1 database to write to")
+	influxUsername := flag.String("influx-username", "", "InfluxDB v1 username")
+	influxPassword := flag.String("influx-password", "", "InfluxDB v1 password, or set WGD2MQTT_INFLUX_PASSWORD")
+	influxOrg := flag.String("influx-org", "", "InfluxDB v2 organization")
+	influxBucket := flag.String("influx-bucket", "", "InfluxDB v2 bucket to write to, instead of -influx-database")
+	influxToken := flag.String("influx-token", "", "InfluxDB v2 API token, or set WGD2MQTT_INFLUX_TOKEN")
+	influxMeasurement := flag.String("influx-measurement", "weather", "InfluxDB measurement to write observations to")
+	remoteWriteURL := flag.String("remote-write-url", "", "Prometheus remote-write endpoint to also push metrics to on each observation, such as for Grafana Cloud or Mimir")
+	remoteWriteUsername := flag.String("remote-write-username", "", "Username for remote-write basic authentication")
+	remoteWritePassword := flag.String("remote-write-password", "", "Password for remote-write basic authentication, or set WGD2MQTT_REMOTE_WRITE_PASSWORD")
+	remoteWriteToken := flag.String("remote-write-bearer-token", "", "Bearer token for remote-write, instead of basic authentication, or set WGD2MQTT_REMOTE_WRITE_TOKEN")
+	remoteWriteBatch := flag.Int("remote-write-batch", 1, "Number of observations to push metrics for in each remote-write request")
+	webhookURLs := flag.String("webhook-url", "", "Comma separated URLs to also POST observations to as JSON")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log format: text or json")
+	backfillFrom := flag.String("from", "", "First day to backfill, as YYYY-MM-DD")
+	backfillTo := flag.String("to", "", "Last day to backfill, as YYYY-MM-DD; defaults to yesterday")
+	backfillOutput := flag.String("output", backfillOutputLine, "Where to backfill to: influx, using the -influx-* flags, line-protocol or csv")
+	backfillFile := flag.String("output-file", "", "File to write line-protocol or csv backfills to, instead of stdout")
+	dryRun := flag.Bool("dry-run", false, "Log what would be published instead of connecting to the MQTT servers")
+	flag.Usage = usage
+	command, args := parseCommand(os.Args[1:])
+	flag.CommandLine.Parse(args)
+	switch command {
+	case commandFetch:
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "fetch takes the ID of the station to fetch")
+			os.Exit(2)
+		}
+	case commandBackfill:
+		if *backfillFrom == "" {
+			fmt.Fprintln(os.Stderr, "backfill needs the first day to backfill with -from")
+			os.Exit(2)
+		}
+		if *apiCallsPerMinute == 0 {
+			*apiCallsPerMinute = backfillCallsPerMinute
+		}
+	case commandCheckConfig:
+		if flag.NArg() > 1 {
+			fmt.Fprintln(os.Stderr, "check-config takes at most one config file")
+			os.Exit(2)
+		}
+		if flag.NArg() == 1 {
+			*configFile = flag.Arg(0)
+		}
+		if *configFile == "" {
+			fmt.Fprintln(os.Stderr, "check-config needs a config file, given as an argument or with -config")
+			os.Exit(2)
+		}
+	}
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	var cfg *config
+	if *configFile != "" {
+		cfg, err = loadConfig(*configFile)
+		if err != nil {
+			fatal("Failed to load config", "err", err)
+		}
+		if err = applyConfig(flag.CommandLine, cfg); err != nil {
+			fatal("Failed to apply config", "err", err)
+		}
+	}
+	clientIDSet := false
+	flag.Visit(func(f *flag.Flag) { clientIDSet = clientIDSet || f.Name == "clientid" })
+	if *persistentSession && !clientIDSet {
+		// The default client ID changes on every start, which would leave
+		// an abandoned session on the broker each time.
+		*clientid = "wgd2mqtt-" + hostname
+	}
+	if *offlineBuffer < 0 {
+		fatal("-offline-buffer must not be negative", "offline-buffer", *offlineBuffer)
+	}
+	if *sinkBuffer < 1 {
+		fatal("-sink-buffer must be at least 1", "sink-buffer", *sinkBuffer)
+	}
+	if *apiKey, err = resolveSecret(*apiKey, *apiKeyFile, "WGD2MQTT_API_KEY", "WGD2MQTT_APIKEY"); err != nil {
+		fatal("Failed to read API key", "err", err)
+	}
+	if *password, err = resolveSecret(*password, *passwordFile, "WGD2MQTT_MQTT_PASSWORD", "WGD2MQTT_PASSWORD"); err != nil {
+		fatal("Failed to read password", "err", err)
+	}
+	if *httpPassword, err = resolveSecret(*httpPassword, "", "WGD2MQTT_HTTP_PASSWORD"); err != nil {
+		fatal("Failed to read HTTP password", "err", err)
+	}
+	if *metricsAddr != "" {
+		*httpListen = *metricsAddr
+	}
+	if (*httpTLSCert == "") != (*httpTLSKey == "") {
+		fatal("-http-tls-cert and -http-tls-key must be given together")
+	}
+	if *influxPassword, err = resolveSecret(*influxPassword, "", "WGD2MQTT_INFLUX_PASSWORD"); err != nil {
+		fatal("Failed to read InfluxDB password", "err", err)
+	}
+	if *influxToken, err = resolveSecret(*influxToken, "", "WGD2MQTT_INFLUX_TOKEN"); err != nil {
+		fatal("Failed to read InfluxDB token", "err", err)
+	}
+	if *remoteWritePassword, err = resolveSecret(*remoteWritePassword, "", "WGD2MQTT_REMOTE_WRITE_PASSWORD"); err != nil {
+		fatal("Failed to read remote-write password", "err", err)
+	}
+	if *remoteWriteToken, err = resolveSecret(*remoteWriteToken, "", "WGD2MQTT_REMOTE_WRITE_TOKEN"); err != nil {
+		fatal("Failed to read remote-write bearer token", "err", err)
+	}
+	if *forecastInterval != 0 && *forecastInterval < minInterval {
+		fatal("-forecast-interval is too short", "forecast-interval", *forecastInterval, "min", minInterval)
+	}
+	if *alertsInterval != 0 && *alertsInterval < minInterval {
+		fatal("-alerts-interval is too short", "alerts-interval", *alertsInterval, "min", minInterval)
+	}
+	if *staleAfter < 1 {
+		fatal("-stale-after must be at least 1", "stale-after", *staleAfter)
+	}
+	if *qos < 0 || *qos > 2 {
+		fatal("-qos must be 0, 1 or 2", "qos", *qos)
+	}
+	var properties map[string]propertyConfig
+	if cfg != nil {
+		if err := cfg.validate(); err != nil {
+			fatal("Invalid config", "err", err)
+		}
+		properties = cfg.Properties
+	}
+	selectedUnits, err := parseUnits(*unitsName)
+	if err != nil {
+		fatal("Invalid -units", "err", err)
+	}
+
+	topics, err := newTopicTemplate(*topicTmpl, *topicPrefix, *area)
+	if err != nil {
+		fatal("Invalid -topic-template", "err", err)
+	}
+
+	// Stations given with -stations replace those in the config file.
+	stationConfigs := parseStations(*stationList)
+	if len(stationConfigs) == 0 && cfg != nil {
+		stationConfigs = cfg.Stations
+	}
+	var stationLocation *geoArea
+	if *location != "" {
+		a, err := parseGeoArea(*location)
+		if err == nil && a.radius != 0 {
+			err = fmt.Errorf("expected lat,lon, got %q", *location)
+		}
+		if err != nil {
+			fatal("Invalid -location", "err", err)
+		}
+		stationLocation = &a
+	}
+	var lookupArea *geoArea
+	if *geolookup != "" {
+		a, err := parseGeoArea(*geolookup)
+		if err != nil {
+			fatal("Invalid -geolookup", "err", err)
+		}
+		if *geolookupCount < 1 {
+			fatal("-geolookup-count must be at least 1", "geolookup-count", *geolookupCount)
+		}
+		if *geolookupInterval < minInterval {
+			fatal("-geolookup-interval is too short", "geolookup-interval", *geolookupInterval, "min", minInterval)
+		}
+		lookupArea = &a
+	}
+	if command == commandFetch {
+		stationConfigs = []stationConfig{fetchStationConfig(stationConfigs, flag.Arg(0))}
+		lookupArea = nil
+	}
+	if len(stationConfigs) == 0 && lookupArea == nil {
+		fatal("No stations configured, pass -stations, -geolookup or set them in -config")
+	}
+	gatherer := newMetricGatherer(prometheus.DefaultGatherer, selectedUnits, properties)
+	var sinks []Sink
+	var influx *influxSink
+	if *influxURL != "" {
+		influx, err = newInfluxSink(influxOptions{
+			url:         *influxURL,
+			measurement: *influxMeasurement,
+			area:        *area,
+			timeout:     *httpTimeout,
+			database:    *influxDatabase,
+			username:    *influxUsername,
+			password:    *influxPassword,
+			org:         *influxOrg,
+			bucket:      *influxBucket,
+			token:       *influxToken,
+		})
+		if err != nil {
+			fatal("Invalid InfluxDB settings", "err", err)
+		}
+		sinks = append(sinks, influx)
+	}
+	var remoteWrite *remoteWriteSink
+	if *remoteWriteURL != "" {
+		if remoteWrite, err = newRemoteWriteSink(remoteWriteOptions{
+			url:         *remoteWriteURL,
+			username:    *remoteWriteUsername,
+			password:    *remoteWritePassword,
+			bearerToken: *remoteWriteToken,
+			timeout:     *httpTimeout,
+			batch:       *remoteWriteBatch,
+			gatherer:    gatherer,
+		}); err != nil {
+			fatal("Invalid remote-write settings", "err", err)
+		}
+		sinks = append(sinks, remoteWrite)
+	}
+	// The published properties, for the formats that name them.
+	info := propertyInfo(updaterOptions{units: selectedUnits, properties: properties})
+	var webhooks []webhookConfig
+	for _, u := range strings.Split(*webhookURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			webhooks = append(webhooks, webhookConfig{URL: u})
+		}
+	}
+	if cfg != nil {
+		webhooks = append(webhooks, cfg.Webhooks...)
+	}
+	for _, c := range webhooks {
+		webhook, err := newWebhookSink(c, *httpTimeout, info)
+		if err != nil {
+			fatal("Invalid webhook", "err", err)
+		}
+		sinks = append(sinks, webhook)
+	}
+
+	var cache *observationCache
+	if *cacheFile != "" {
+		if cache, err = loadObservationCache(*cacheFile); err != nil {
+			fatal("Failed to load observation cache", "err", err)
+		}
+	}
+
+	var uploads *uploadStore
+	if *listenPWS != "" || *listenTempest != "" {
+		uploads = newUploadStore()
+	}
+	defaults := stationDefaults{
+		provider: *providerName,
+		providerOpts: providerOptions{
+			apiKey:      *apiKey,
+			baseURL:     *apiBaseURL,
+			httpTimeout: *httpTimeout,
+			limiter:     newAPILimiter(*apiCallsPerMinute, *apiCallsPerDay),
+			uploads:     uploads,
+			location:    stationLocation,
+		},
+		opts: updaterOptions{
+			interval:      *interval,
+			units:         selectedUnits,
+			topics:        topics,
+			area:          *area,
+			spreadStart:   *spreadStart,
+			jitter:        *jitter,
+			retries:       *retries,
+			retryDelay:    *retryDelay,
+			retryMaxDelay: *retryMaxDelay,
+
+			publishProperties: *publishProperties,
+			publishJSON:       *publishJSON,
+			qos:               byte(*qos),
+			retain:            *retain,
+			properties:        properties,
+			republishInterval: *republishInterval,
+			staleAfter:        *staleAfter,
+			messageExpiry:     *messageExpiry,
+			staleTTL:          *staleTTL,
+			maxObservationAge: *maxObservationAge,
+			forecastInterval:  *forecastInterval,
+			alertsInterval:    *alertsInterval,
+			astronomy:         *astronomy,
+			dailySummary:      *dailySummary,
+			sinks:             sinks,
+			cache:             cache,
+			observed:          newUploadStore(),
+			haDiscovery:       *haDiscovery,
+		},
+	}
+	var locator geolocator
+	var discovered []stationConfig
+	// check-config validates -geolookup without looking up stations.
+	if lookupArea != nil && (command == commandRun || command == commandBackfill) {
+		p, err := newProvider(*providerName, defaults.providerOpts)
+		if err != nil {
+			fatal("Invalid provider for -geolookup", "err", err)
+		}
+		var ok bool
+		if locator, ok = p.(geolocator); !ok {
+			fatal("Provider doesn't support -geolookup", "provider", p.Name())
+		}
+		if discovered, err = lookupStations(ctx, locator, *lookupArea, *geolookupCount); err != nil {
+			if len(stationConfigs) == 0 {
+				fatal("Failed to look up nearby stations", "err", err)
+			}
+			slog.Warn("Failed to look up nearby stations", "err", err)
+		}
+	}
+	stations, err := buildStations(mergeStations(stationConfigs, discovered), defaults)
+	if err != nil {
+		fatal("Invalid station configuration", "err", err)
+	}
+	if len(stations) == 0 && (command == commandRun || command == commandBackfill) {
+		fatal("No stations found near -geolookup", "geolookup", *geolookup)
+	}
+	if command == commandFetch {
+		if err := fetchObservation(ctx, stations[0]); err != nil {
+			fatal("Failed to fetch observation", "station", stations[0].id, "err", err)
+		}
+		return
+	}
+	if command == commandBackfill {
+		from, err := time.ParseInLocation("2006-01-02", *backfillFrom, time.Local)
+		if err != nil {
+			fatal("Invalid -from", "err", err)
+		}
+		to := time.Now().AddDate(0, 0, -1)
+		if *backfillTo != "" {
+			if to, err = time.ParseInLocation("2006-01-02", *backfillTo, time.Local); err != nil {
+				fatal("Invalid -to", "err", err)
+			}
+		}
+		if to.Before(from) {
+			fatal("-to is before -from", "from", *backfillFrom, "to", to.Format("2006-01-02"))
+		}
+		sink, closeSink, err := newBackfillSink(*backfillOutput, *backfillFile, influx, *influxMeasurement, *area, stations)
+		if err != nil {
+			fatal("Invalid backfill output", "err", err)
+		}
+		for _, st := range stations {
+			n, err := backfill(ctx, st, from, to, sink)
+			if err != nil {
+				fatal("Backfill failed", "station", st.id, "err", err)
+			}
+			slog.Info("Backfilled station", "station", st.id, "observations", n)
+		}
+		if err := closeSink(); err != nil {
+			fatal("Failed to write backfill", "err", err)
+		}
+		return
+	}
+
+	tlsConfig, err := newTLSConfig(*caFile, *clientCert, *clientKey, *tlsServerName, *tlsInsecure)
+	if err != nil {
+		fatal("Failed to set up TLS", "err", err)
+	}
+
+	if *format, err = parseFormat(*format); err != nil {
+		fatal("Invalid -format", "err", err)
+	}
 
-				if data.CurrentObservation.WindDegrees != -9999 {
-					client.Publish(topic(stationID, "wind_degrees"), 0, true, data.CurrentObservation.WindDegrees)
-					windDirection.WithLabelValues(stationID, area).Set(float64(data.CurrentObservation.WindDegrees))
+	// The broker given by the flags comes first, followed by those in the
+	// config file.
+	specs := []brokerSpec{{
+		settings: mqttSettings{
+			server:   *server,
+			clientID: *clientid,
+			username: *username,
+			password: *password,
+			tls:      tlsConfig,
+		},
+		version: *mqttVersion,
+		format:  *format,
+	}}
+	if cfg != nil {
+		for i, c := range cfg.Brokers {
+			spec, err := c.spec(*clientid, *mqttVersion, *format)
+			if err != nil {
+				fatal("Invalid broker in config", "broker", i+1, "err", err)
+			}
+			specs = append(specs, spec)
+		}
+	}
+	// Queue publishes to every broker when there are several, so that a
+	// slow one can't hold up the others.
+	rate := *publishRate
+	if len(specs) > 1 && rate == 0 {
+		rate = math.Inf(1)
+	}
+	if command == commandCheckConfig {
+		for i, spec := range specs {
+			b, err := newBroker(spec, topics, *topicTmpl, *topicPrefix, *area)
+			if err != nil {
+				fatal("Invalid broker settings", "broker", i+1, "err", err)
+			}
+			if *commands && b.format == formatTopics {
+				if _, err := commandFilter(b.topics); err != nil {
+					fatal("Invalid -topic-template for -commands", "err", err)
 				}
-				client.Publish(topic(stationID, "wind_kph"), 0, true, data.CurrentObservation.WindKph)
-				windSpeed.WithLabelValues(stationID, area).Set(data.CurrentObservation.WindKph)
+			}
+		}
+		fmt.Printf("%s is valid: %d stations, %d brokers\n", *configFile, len(stations), len(specs))
+		return
+	}
 
-				client.Publish(topic(stationID, "temperature_feels_like_degrees"), 0, true, data.CurrentObservation.FeelsLikeC)
-				if value, err := strconv.ParseFloat(data.CurrentObservation.PrecipTodayMetric, 64); err == nil {
-					client.Publish(topic(stationID, "precip_today_mm"), 0, true, value)
-					precipitation.WithLabelValues(stationID, area).Set(value)
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		fatal("Failed to set up tracing", "err", err)
+	}
+
+	var bs brokers
+	var sup *supervisor
+	ready := make(chan struct{})
+	for _, spec := range specs {
+		b, err := newBroker(spec, topics, *topicTmpl, *topicPrefix, *area)
+		if err != nil {
+			fatal("Invalid broker settings", "err", err)
+		}
+		if *commands && b.format == formatTopics {
+			if b.cmdFilter, err = commandFilter(b.topics); err != nil {
+				fatal("Invalid -topic-template for -commands", "err", err)
+			}
+		}
+		s := spec.settings
+		s.persistentSession = *persistentSession
+		// statusTopic carries "online" while the bridge is connected,
+		// and "offline" (via the last will) once it is not.
+		s.willTopic, s.willPayload = b.statusTopic, "offline"
+		var homie *homieSink
+		switch b.format {
+		case formatHomie:
+			// The Homie device state takes the place of the status topic.
+			homie = newHomieSink(b, s.clientID, info)
+			b.sink, b.statusTopic, b.offline = homie, homie.stateTopic(), "disconnected"
+			s.willTopic, s.willPayload = b.statusTopic, "lost"
+		case formatSenML:
+			b.sink = &senmlSink{b, topics, info, byte(*qos), *retain}
+		}
+		// Called on every (re)connect, so consumers recover after a
+		// broker restart.
+		s.onConnect = func() {
+			<-ready
+			if homie != nil {
+				homie.announce()
+			} else {
+				b.pub.Publish(b.statusTopic, 1, true, "online")
+			}
+			go b.pub.flushOffline()
+			if b.format != formatTopics {
+				return
+			}
+			if *haDiscovery {
+				for _, st := range sup.stations() {
+					b.publishDiscovery(*haDiscoveryPrefix, st)
 				}
-				heartbeat.WithLabelValues(stationID).SetToCurrentTime()
+			}
+			if *commands {
+				subscribeCommands(b.conn, b.topics, b.cmdFilter, sup)
 			}
 		}
-		fmt.Printf("%s: Sleeping\n", stationID)
-		<-t.C
+		s.onConnectionLost = func(err error) {
+			slog.Warn("Lost connection to MQTT server, reconnecting", "server", s.server, "err", err)
+		}
+		if *dryRun {
+			b.conn = dryRunConn{s.server}
+			go s.onConnect()
+		} else {
+			if b.conn, err = connectMQTT(ctx, spec.version, s); err != nil {
+				fatal("Failed to connect to MQTT server", "server", s.server, "err", err)
+			}
+			slog.Info("Connected to MQTT server", "server", s.server, "version", spec.version)
+		}
+		b.pub = newPublishLimiter(b.conn, rate, *publishBuffer, *offlineBuffer)
+		bs = append(bs, b)
+	}
 
+	// Brokers in other formats get observations as sinks, which the
+	// stations built above don't have yet.
+	for _, b := range bs {
+		if b.sink != nil {
+			defaults.opts.sinks = append(defaults.opts.sinks, b.sink)
+		}
+	}
+	// Each sink is written from its own queue, so that a slow one doesn't
+	// hold up the updaters.
+	var sinkQueues []*sinkQueue
+	for i, s := range defaults.opts.sinks {
+		q := newSinkQueue(s, *sinkBuffer)
+		sinkQueues = append(sinkQueues, q)
+		defaults.opts.sinks[i] = q
+	}
+	for i := range stations {
+		stations[i].opts.sinks = defaults.opts.sinks
 	}
-}
 
-func main() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		fmt.Println("signal received, exiting")
-		os.Exit(0)
-	}()
+	h := newHealth(bs.conns(), 0)
+	topicBrokers := bs.topicBrokers()
+	sup = newSupervisor(ctx, topicBrokers, h)
+	if *haDiscovery {
+		sup.onStart = func(st station) {
+			for _, b := range topicBrokers {
+				b.publishDiscovery(*haDiscoveryPrefix, st)
+			}
+		}
+		sup.onStop = func(st station) {
+			for _, b := range topicBrokers {
+				clearDiscovery(b.pub, *haDiscoveryPrefix, st)
+			}
+		}
+	}
+	close(ready)
 
-	hostname, _ := os.Hostname()
+	if *listenTempest != "" {
+		if err := newTempestListener(uploads).listen(ctx, *listenTempest); err != nil {
+			fatal("Failed to listen for Tempest broadcasts", "err", err)
+		}
+		slog.Info("Receiving Tempest broadcasts", "addr", *listenTempest)
+	}
 
-	server := flag.String("server", "tcp://127.0.0.1:1883", "The full url of the MQTT server to connect to ex: tcp://127.0.0.1:1883")
-	clientid := flag.String("clientid", hostname+strconv.Itoa(time.Now().Second()), "A clientid for the connection")
-	username := flag.String("username", "", "A username to authenticate to the MQTT server")
-	password := flag.String("password", "", "Password to match username")
-	apiKey := flag.String("apikey", "", "API key")
-	stations := flag.String("stations", "", "Comma separated list of stations")
-	flag.Parse()
+	var pwsSrv *http.Server
+	if *listenPWS != "" {
+		pwsSrv = &http.Server{Addr: *listenPWS, Handler: uploads.handler()}
+		go func() {
+			if err := pwsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("PWS upload listener failed", "err", err)
+			}
+		}()
+		slog.Info("Accepting uploads from local weather stations", "addr", *listenPWS)
+	}
 
-	connOpts := &MQTT.ClientOptions{
-		ClientID:             *clientid,
-		CleanSession:         true,
-		Username:             *username,
-		Password:             *password,
-		MaxReconnectInterval: 1 * time.Second,
-		KeepAlive:            int64(30 * time.Second),
-		TLSConfig:            tls.Config{InsecureSkipVerify: true, ClientAuth: tls.NoClientCert},
+	sup.apply(stations)
+	go notifySystemd(ctx, h)
+
+	// reloadMu guards stationConfigs and discovered.
+	var reloadMu sync.Mutex
+	applyStations := func() (int, error) {
+		configs := mergeStations(stationConfigs, discovered)
+		if len(configs) == 0 {
+			return 0, fmt.Errorf("no stations configured")
+		}
+		stations, err := buildStations(configs, defaults)
+		if err != nil {
+			return 0, err
+		}
+		sup.apply(stations)
+		return len(stations), nil
 	}
-	connOpts.AddBroker(*server)
 
-	client := MQTT.NewClient(connOpts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	} else {
-		fmt.Printf("Connected to %s\n", *server)
+	// reload rebuilds the stations from the config file, restarting those
+	// whose settings changed. Stations given with -stations, and all other
+	// settings, only change on restart.
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		configs := parseStations(*stationList)
+		if len(configs) == 0 && *configFile != "" {
+			cfg, err := loadConfig(*configFile)
+			if err != nil {
+				return err
+			}
+			configs = cfg.Stations
+		}
+		if len(configs) == 0 && lookupArea == nil {
+			return fmt.Errorf("no stations configured")
+		}
+		stationConfigs = configs
+		n, err := applyStations()
+		if err != nil {
+			return err
+		}
+		slog.Info("Reloaded configuration", "stations", n)
+		return nil
 	}
 
-	for _, stationID := range strings.Split(*stations, ",") {
-		go updater(*apiKey, stationID, client)
+	if lookupArea != nil {
+		go func() {
+			for sleep(ctx, *geolookupInterval) {
+				found, err := lookupStations(ctx, locator, *lookupArea, *geolookupCount)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Warn("Failed to look up nearby stations", "err", err)
+					}
+					continue
+				}
+				reloadMu.Lock()
+				discovered = found
+				_, err = applyStations()
+				reloadMu.Unlock()
+				if err != nil {
+					slog.Error("Failed to apply nearby stations", "err", err)
+				}
+			}
+		}()
 	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				slog.Error("Failed to reload configuration", "err", err)
+			}
+		}
+	}()
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	var srv *http.Server
+	if !*noHTTP && !*noMetrics {
+		mux := http.NewServeMux()
+		mux.Handle(*metricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+		mux.HandleFunc("/healthz", h.serveHealthz)
+		mux.HandleFunc("/readyz", h.serveReadyz)
+		mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := reload(); err != nil {
+				slog.Error("Failed to reload configuration", "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		var handler http.Handler = mux
+		if *httpUsername != "" {
+			handler = withBasicAuth(mux, *httpUsername, *httpPassword)
+		}
+		srv = &http.Server{Addr: *httpListen, Handler: handler}
+		go func() {
+			var err error
+			if *httpTLSCert != "" {
+				err = srv.ListenAndServeTLS(*httpTLSCert, *httpTLSKey)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				fatal("HTTP server failed", "err", err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	sup.wait()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+	if srv != nil {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to shut down HTTP server", "err", err)
+		}
+	}
+	if pwsSrv != nil {
+		if err := pwsSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to shut down PWS upload listener", "err", err)
+		}
+	}
+	flushDeadline, _ := shutdownCtx.Deadline()
+	for _, q := range sinkQueues {
+		if !q.close(time.Until(flushDeadline)) {
+			slog.Warn("Timed out waiting for queued sink writes", "sink", q.Name())
+		}
+	}
+	if remoteWrite != nil {
+		if err := remoteWrite.flush(); err != nil {
+			slog.Warn("Failed to push remaining metrics to remote-write", "err", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, b := range bs {
+		wg.Add(1)
+		go func(b *broker) {
+			defer wg.Done()
+			if !b.pub.close(time.Until(flushDeadline)) {
+				slog.Warn("Timed out waiting for queued publishes", "server", b.server)
+			}
+			offline := b.conn.publish(publishRequest{topic: b.statusTopic, qos: 1, retained: true, payload: b.offline})
+			if err := offline(time.Second); err != nil {
+				slog.Warn("Failed to publish offline status", "server", b.server, "err", err)
+			}
+			b.conn.disconnect(250 * time.Millisecond)
+		}(b)
+	}
+	wg.Wait()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("Failed to flush traces", "err", err)
+	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// propertyGauges returns the gauge each property is exported as, for those
+// that have one.
+func propertyGauges(us []units) map[string]*prometheus.GaugeVec {
+	gauges := map[string]*prometheus.GaugeVec{
+		"relative_humidity_percent": humidity,
+		"absolute_humidity_gm3":     absoluteHumidity,
+		"pressure_mb":               pressure,
+		"wind_degrees":              windDirection,
+		"uv_index":                  uvIndex,
+		"solar_radiation_wm2":       solarRadiation,
+	}
+	for _, u := range us {
+		gauges[u.temperatureTopic] = u.temperature
+		gauges[u.dewPointTopic] = u.dewPoint
+		gauges[u.windSpeedTopic] = u.windSpeed
+		gauges[u.precipTopic] = u.precipitation
+		gauges[u.windGustTopic] = u.windGust
+		gauges[u.precip1hrTopic] = u.precip1hr
+		gauges[u.precipRateTopic] = u.precipRate
+		gauges[u.precip24hTopic] = u.precip24h
+		gauges[u.visibilityTopic] = u.visibility
+		gauges[u.heatIndexTopic] = u.heatIndex
+		gauges[u.windChillTopic] = u.windChill
+	}
+	return gauges
+}
+
+var fqNamePattern = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// metricName returns the name of the metric c collects.
+func metricName(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc, 1)
+	c.Describe(ch)
+	if m := fqNamePattern.FindStringSubmatch((<-ch).String()); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// renamingGatherer exports metrics under other names, so that the gauges of
+// renamed properties follow them.
+type renamingGatherer struct {
+	prometheus.Gatherer
+	// names maps metric names to what they are exported as, or to "" to
+	// leave them out.
+	names map[string]string
+}
+
+// newMetricGatherer returns g, renaming and leaving out the gauges of the
+// properties renamed or disabled in properties.
+func newMetricGatherer(g prometheus.Gatherer, us []units, properties map[string]propertyConfig) prometheus.Gatherer {
+	names := map[string]string{}
+	for property, gauge := range propertyGauges(us) {
+		p := properties[property]
+		switch {
+		case p.Disabled:
+			names[metricName(gauge)] = ""
+		case p.Metric != "":
+			names[metricName(gauge)] = p.Metric
+		case p.Name != "":
+			names[metricName(gauge)] = p.Name
+		}
+	}
+	if len(names) == 0 {
+		return g
+	}
+	return renamingGatherer{g, names}
+}
+
+func (g renamingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	kept := families[:0]
+	for _, mf := range families {
+		if name, ok := g.names[mf.GetName()]; ok {
+			if name == "" {
+				continue
+			}
+			mf.Name = &name
+		}
+		kept = append(kept, mf)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].GetName() < kept[j].GetName() })
+	return kept, err
+}
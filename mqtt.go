@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttConn is a connection to an MQTT broker, speaking either MQTT 3.1.1 or
+// MQTT 5. It reconnects by itself if the connection is lost.
+type mqttConn interface {
+	// publish sends req, and returns a function that waits up to timeout
+	// for the publish to complete.
+	publish(req publishRequest) func(timeout time.Duration) error
+	// subscribe subscribes to filter, calling handler with every message
+	// received on it. Subscriptions last until the connection is lost.
+	subscribe(filter string, handler func(topic string, payload []byte)) error
+	isConnected() bool
+	// disconnect closes the connection, waiting up to timeout for it to
+	// close cleanly.
+	disconnect(timeout time.Duration)
+}
+
+var errTimeout = errors.New("timed out")
+
+// subscribeTimeout is how long to wait for the broker to acknowledge a
+// subscription.
+const subscribeTimeout = 10 * time.Second
+
+// mqttSettings holds what's needed to connect to the broker.
+type mqttSettings struct {
+	server   string
+	clientID string
+	username string
+	password string
+	tls      *tls.Config
+
+	// persistentSession asks the broker to keep the session, including
+	// QoS 1 and 2 publishes in flight, across reconnects and restarts,
+	// which needs a client ID that doesn't change.
+	persistentSession bool
+
+	// willTopic receives a retained willPayload once the connection is
+	// lost.
+	willTopic   string
+	willPayload string
+
+	// onConnect is called on every (re)connect, and onConnectionLost when
+	// the connection is lost.
+	onConnect        func()
+	onConnectionLost func(error)
+}
+
+// connectMQTT connects to the broker using MQTT version 3 (3.1.1) or 5.
+func connectMQTT(ctx context.Context, version int, s mqttSettings) (mqttConn, error) {
+	switch version {
+	case 3:
+		return connectMQTTv3(s)
+	case 5:
+		return connectMQTTv5(ctx, s)
+	}
+	return nil, fmt.Errorf("unsupported MQTT version %d, expected 3 or 5", version)
+}
+
+// sessionExpiry is how long an MQTT 5 broker keeps a persistent session
+// after the connection is lost.
+const sessionExpiry = 24 * time.Hour
+
+type mqttV3 struct {
+	client MQTT.Client
+	// connected is false while reconnecting, when the client still
+	// reports itself as connected.
+	connected atomic.Bool
+}
+
+func connectMQTTv3(s mqttSettings) (*mqttV3, error) {
+	m := &mqttV3{}
+	opts := &MQTT.ClientOptions{
+		ClientID:             s.clientID,
+		CleanSession:         !s.persistentSession,
+		Username:             s.username,
+		Password:             s.password,
+		AutoReconnect:        true,
+		MaxReconnectInterval: 1 * time.Second,
+		KeepAlive:            int64(30 * time.Second),
+	}
+	opts.AddBroker(s.server)
+	opts.SetTLSConfig(s.tls)
+	opts.SetWill(s.willTopic, s.willPayload, 1, true)
+	opts.OnConnectionLost = func(c MQTT.Client, err error) {
+		m.connected.Store(false)
+		s.onConnectionLost(err)
+	}
+	opts.OnConnect = func(c MQTT.Client) {
+		m.connected.Store(true)
+		s.onConnect()
+	}
+
+	m.client = MQTT.NewClient(opts)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return m, nil
+}
+
+func (m *mqttV3) publish(req publishRequest) func(time.Duration) error {
+	token := m.client.Publish(req.topic, req.qos, req.retained, req.payload)
+	return func(timeout time.Duration) error {
+		if !token.WaitTimeout(timeout) {
+			return errTimeout
+		}
+		return token.Error()
+	}
+}
+
+func (m *mqttV3) subscribe(filter string, handler func(string, []byte)) error {
+	token := m.client.Subscribe(filter, 1, func(c MQTT.Client, msg MQTT.Message) {
+		handler(msg.Topic(), msg.Payload())
+	})
+	if !token.WaitTimeout(subscribeTimeout) {
+		return errTimeout
+	}
+	return token.Error()
+}
+
+func (m *mqttV3) isConnected() bool { return m.connected.Load() }
+
+func (m *mqttV3) disconnect(timeout time.Duration) {
+	m.client.Disconnect(uint(timeout / time.Millisecond))
+}
+
+// mqttV5 also sends the message expiry interval and user properties of
+// publishes, which MQTT 3.1.1 has no room for.
+type mqttV5 struct {
+	cm        *autopaho.ConnectionManager
+	connected atomic.Bool
+
+	mu       sync.Mutex
+	handlers map[string]func(string, []byte)
+}
+
+func connectMQTTv5(ctx context.Context, s mqttSettings) (*mqttV5, error) {
+	serverURL, err := url.Parse(s.server)
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttV5{handlers: map[string]func(string, []byte){}}
+	lost := func(err error) {
+		if m.connected.Swap(false) {
+			s.onConnectionLost(err)
+		}
+	}
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        s.tls,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !s.persistentSession,
+		ReconnectBackoff:              autopaho.NewConstantBackoff(time.Second),
+		ConnectUsername:               s.username,
+		ConnectPassword:               []byte(s.password),
+		WillMessage: &paho.WillMessage{
+			Topic:   s.willTopic,
+			Payload: []byte(s.willPayload),
+			QoS:     1,
+			Retain:  true,
+		},
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			m.connected.Store(true)
+			go s.onConnect()
+		},
+		OnConnectError: func(err error) {
+			slog.Debug("MQTT connection attempt failed", "err", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          s.clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){m.received},
+			OnClientError:     lost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				lost(fmt.Errorf("disconnected by server, reason code %d", d.ReasonCode))
+			},
+		},
+	}
+	if s.persistentSession {
+		cfg.SessionExpiryInterval = uint32(sessionExpiry / time.Second)
+	}
+	// Connection attempts continue in the background until ctx is cancelled
+	// or disconnect is called, so this one is just for the first attempt.
+	if m.cm, err = autopaho.NewConnection(context.Background(), cfg); err != nil {
+		return nil, err
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err = m.cm.AwaitConnection(connectCtx); err != nil {
+		m.cm.Disconnect(context.Background())
+		return nil, fmt.Errorf("no connection within 30s: %v", err)
+	}
+	return m, nil
+}
+
+// publish sends req before returning, so that publishes to the same topic
+// stay in order.
+func (m *mqttV5) publish(req publishRequest) func(time.Duration) error {
+	var payload []byte
+	switch p := req.payload.(type) {
+	case []byte:
+		payload = p
+	case string:
+		payload = []byte(p)
+	default:
+		payload = []byte(fmt.Sprint(p))
+	}
+	props := &paho.PublishProperties{}
+	for _, u := range req.properties.user {
+		props.User.Add(u.key, u.value)
+	}
+	if req.retained && req.properties.expiry > 0 {
+		expiry := uint32(req.properties.expiry / time.Second)
+		props.MessageExpiry = &expiry
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err := m.cm.Publish(ctx, &paho.Publish{
+		Topic:      req.topic,
+		QoS:        req.qos,
+		Retain:     req.retained,
+		Payload:    payload,
+		Properties: props,
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errTimeout
+	}
+	return func(time.Duration) error { return err }
+}
+
+func (m *mqttV5) subscribe(filter string, handler func(string, []byte)) error {
+	m.mu.Lock()
+	m.handlers[filter] = handler
+	m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), subscribeTimeout)
+	defer cancel()
+	_, err := m.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: 1}},
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errTimeout
+	}
+	return err
+}
+
+// received passes a message to the handlers of the filters it matches.
+func (m *mqttV5) received(pr paho.PublishReceived) (bool, error) {
+	var matched []func(string, []byte)
+	m.mu.Lock()
+	for filter, handler := range m.handlers {
+		if topicMatches(filter, pr.Packet.Topic) {
+			matched = append(matched, handler)
+		}
+	}
+	m.mu.Unlock()
+	for _, handler := range matched {
+		handler(pr.Packet.Topic, pr.Packet.Payload)
+	}
+	return len(matched) > 0, nil
+}
+
+func (m *mqttV5) isConnected() bool { return m.connected.Load() }
+
+func (m *mqttV5) disconnect(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	m.cm.Disconnect(ctx)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type openMeteoResponse struct {
+	Latitude  reading `json:"latitude"`
+	Longitude reading `json:"longitude"`
+	Current   struct {
+		Time          reading `json:"time"`
+		Temperature   reading `json:"temperature_2m"`
+		Humidity      reading `json:"relative_humidity_2m"`
+		FeelsLike     reading `json:"apparent_temperature"`
+		DewPoint      reading `json:"dew_point_2m"`
+		Pressure      reading `json:"pressure_msl"`
+		WindSpeed     reading `json:"wind_speed_10m"`
+		WindDirection reading `json:"wind_direction_10m"`
+		WindGust      reading `json:"wind_gusts_10m"`
+	} `json:"current"`
+	// Hourly values, starting at local midnight, for what isn't available
+	// as current weather. Precipitation is the sum of the preceding hour.
+	Hourly struct {
+		Time           []reading `json:"time"`
+		Precipitation  []reading `json:"precipitation"`
+		Visibility     []reading `json:"visibility"` // m
+		UV             []reading `json:"uv_index"`
+		SolarRadiation []reading `json:"shortwave_radiation"`
+	} `json:"hourly"`
+}
+
+const (
+	openMeteoCurrent = "temperature_2m,relative_humidity_2m,apparent_temperature,dew_point_2m,pressure_msl,wind_speed_10m,wind_direction_10m,wind_gusts_10m"
+	openMeteoHourly  = "precipitation,visibility,uv_index,shortwave_radiation"
+)
+
+// openMeteo fetches modelled weather from the Open-Meteo forecast API, which
+// needs no API key. It has no stations, so it reports the weather at the
+// location of the station, and the station ID only names it.
+type openMeteo struct {
+	httpClient *http.Client
+	baseURL    string
+	archiveURL string
+	location   *geoArea
+	limiter    *apiLimiter
+}
+
+func newOpenMeteo(httpClient *http.Client, opts providerOptions) (*openMeteo, error) {
+	if opts.location == nil {
+		return nil, fmt.Errorf("the openmeteo provider requires -location, or the latitude and longitude of the station")
+	}
+	// Past weather is served from another host, unless -api-base-url
+	// replaces both.
+	baseURL, archiveURL := opts.baseURL, opts.baseURL
+	if baseURL == "" {
+		baseURL, archiveURL = "https://api.open-meteo.com", "https://archive-api.open-meteo.com"
+	}
+	return &openMeteo{httpClient, strings.TrimSuffix(baseURL, "/"), strings.TrimSuffix(archiveURL, "/"), opts.location, opts.limiter}, nil
+}
+
+func (o *openMeteo) Name() string { return "openmeteo" }
+
+func (o *openMeteo) Observe(ctx context.Context, stationID string) (Observation, error) {
+	q := url.Values{
+		"latitude":        {strconv.FormatFloat(o.location.lat, 'f', -1, 64)},
+		"longitude":       {strconv.FormatFloat(o.location.lon, 'f', -1, 64)},
+		"current":         {openMeteoCurrent},
+		"hourly":          {openMeteoHourly},
+		"forecast_days":   {"1"},
+		"timezone":        {"auto"},
+		"timeformat":      {"unixtime"},
+		"wind_speed_unit": {"kmh"},
+	}
+	if err := o.limiter.wait(ctx); err != nil {
+		return Observation{}, err
+	}
+	return get(ctx, o.httpClient, o.baseURL+"/v1/forecast?"+q.Encode(), stationID, func(r io.Reader) (Observation, error) {
+		obs, err := parseOpenMeteo(r)
+		obs.StationID = stationID
+		return obs, err
+	})
+}
+
+// parseOpenMeteo decodes an Open-Meteo forecast response, taking the hourly
+// values of the hour of the current weather.
+func parseOpenMeteo(r io.Reader) (Observation, error) {
+	var data openMeteoResponse
+	err := decodeJSON(r, &data)
+	if _, partial := err.(schemaError); err != nil && !partial {
+		return Observation{}, err
+	}
+	c, h := data.Current, data.Hourly
+	obs := Observation{
+		ObservedAt:    epochTime(c.Time),
+		Latitude:      data.Latitude,
+		Longitude:     data.Longitude,
+		Temperature:   c.Temperature,
+		FeelsLike:     c.FeelsLike,
+		DewPoint:      c.DewPoint,
+		Humidity:      c.Humidity,
+		WindDirection: c.WindDirection,
+		WindSpeed:     c.WindSpeed,
+		Pressure:      c.Pressure,
+		WindGust:      c.WindGust,
+	}
+
+	hour := -1
+	for i, t := range h.Time {
+		if t.valid && c.Time.valid && t.value <= c.Time.value {
+			hour = i
+		}
+	}
+	at := func(values []reading) reading {
+		if hour < 0 || hour >= len(values) {
+			return reading{}
+		}
+		return values[hour]
+	}
+	obs.Precip1hr = at(h.Precipitation)
+	obs.Visibility = at(h.Visibility).convert(metersToKm)
+	obs.UV = at(h.UV)
+	obs.SolarRadiation = at(h.SolarRadiation)
+	if hour >= 0 && hour < len(h.Precipitation) {
+		// The first hour is the rain of the hour before midnight.
+		today := reading{valid: true}
+		for _, p := range h.Precipitation[1 : hour+1] {
+			today.value += p.value
+		}
+		obs.PrecipToday = today
+	}
+	return obs, err
+}
+
+type openMeteoArchiveResponse struct {
+	Latitude  reading `json:"latitude"`
+	Longitude reading `json:"longitude"`
+	Hourly    struct {
+		Time           []reading `json:"time"`
+		Temperature    []reading `json:"temperature_2m"`
+		Humidity       []reading `json:"relative_humidity_2m"`
+		FeelsLike      []reading `json:"apparent_temperature"`
+		DewPoint       []reading `json:"dew_point_2m"`
+		Pressure       []reading `json:"pressure_msl"`
+		WindSpeed      []reading `json:"wind_speed_10m"`
+		WindDirection  []reading `json:"wind_direction_10m"`
+		WindGust       []reading `json:"wind_gusts_10m"`
+		Precipitation  []reading `json:"precipitation"`
+		SolarRadiation []reading `json:"shortwave_radiation"`
+	} `json:"hourly"`
+}
+
+const openMeteoArchiveHourly = "temperature_2m,relative_humidity_2m,apparent_temperature,dew_point_2m,pressure_msl,wind_speed_10m,wind_direction_10m,wind_gusts_10m,precipitation,shortwave_radiation"
+
+// History returns the hourly weather at the location of the station on day,
+// from the Open-Meteo historical weather API.
+func (o *openMeteo) History(ctx context.Context, stationID string, day time.Time) ([]Observation, error) {
+	date := day.Format("2006-01-02")
+	q := url.Values{
+		"latitude":        {strconv.FormatFloat(o.location.lat, 'f', -1, 64)},
+		"longitude":       {strconv.FormatFloat(o.location.lon, 'f', -1, 64)},
+		"start_date":      {date},
+		"end_date":        {date},
+		"hourly":          {openMeteoArchiveHourly},
+		"timezone":        {"auto"},
+		"timeformat":      {"unixtime"},
+		"wind_speed_unit": {"kmh"},
+	}
+	if err := o.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	var history []Observation
+	err := getJSON(ctx, o.httpClient, o.archiveURL+"/v1/archive?"+q.Encode(), func(r io.Reader) error {
+		var data openMeteoArchiveResponse
+		err := decodeJSON(r, &data)
+		if _, partial := err.(schemaError); err != nil && !partial {
+			return err
+		}
+		h := data.Hourly
+		at := func(values []reading, i int) reading {
+			if i >= len(values) {
+				return reading{}
+			}
+			return values[i]
+		}
+		// The first hour is the rain of the hour before midnight.
+		today := reading{valid: true}
+		for i, t := range h.Time {
+			if i > 0 {
+				today.value += at(h.Precipitation, i).value
+			}
+			history = append(history, Observation{
+				StationID:     stationID,
+				ObservedAt:    epochTime(t),
+				Latitude:      data.Latitude,
+				Longitude:     data.Longitude,
+				Temperature:   at(h.Temperature, i),
+				FeelsLike:     at(h.FeelsLike, i),
+				DewPoint:      at(h.DewPoint, i),
+				Humidity:      at(h.Humidity, i),
+				WindDirection: at(h.WindDirection, i),
+				WindSpeed:     at(h.WindSpeed, i),
+				PrecipToday:   today,
+				Pressure:      at(h.Pressure, i),
+
+				WindGust:       at(h.WindGust, i),
+				Precip1hr:      at(h.Precipitation, i),
+				SolarRadiation: at(h.SolarRadiation, i),
+			})
+		}
+		return nil
+	})
+	return history, err
+}
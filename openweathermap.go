@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type owmResponse struct {
+	ID    int64   `json:"id"`
+	Dt    reading `json:"dt"`
+	Coord struct {
+		Lat reading `json:"lat"`
+		Lon reading `json:"lon"`
+	} `json:"coord"`
+	Main struct {
+		Temp      reading `json:"temp"`
+		FeelsLike reading `json:"feels_like"`
+		Humidity  reading `json:"humidity"`
+		Pressure  reading `json:"pressure"`
+	} `json:"main"`
+	Wind struct {
+		Speed reading `json:"speed"`
+		Deg   reading `json:"deg"`
+		Gust  reading `json:"gust"`
+	} `json:"wind"`
+	Rain struct {
+		OneHour reading `json:"1h"`
+	} `json:"rain"`
+	Visibility reading `json:"visibility"` // m
+}
+
+// openWeatherMap fetches observations from the OpenWeatherMap current
+// weather API. Station IDs are OpenWeatherMap city IDs.
+type openWeatherMap struct {
+	httpClient *http.Client
+	apiKey     string
+	baseURL    string
+	limiter    *apiLimiter
+}
+
+func newOpenWeatherMap(httpClient *http.Client, opts providerOptions) *openWeatherMap {
+	baseURL := opts.baseURL
+	if baseURL == "" {
+		baseURL = "https://api.openweathermap.org"
+	}
+	return &openWeatherMap{httpClient, opts.apiKey, strings.TrimSuffix(baseURL, "/"), opts.limiter}
+}
+
+func (o *openWeatherMap) Name() string { return "openweathermap" }
+
+func (o *openWeatherMap) Observe(ctx context.Context, stationID string) (Observation, error) {
+	q := url.Values{"id": {stationID}, "appid": {o.apiKey}, "units": {"metric"}}
+	if err := o.limiter.wait(ctx); err != nil {
+		return Observation{}, err
+	}
+	return get(ctx, o.httpClient, o.baseURL+"/data/2.5/weather?"+q.Encode(), stationID, parseOpenWeatherMap)
+}
+
+// parseOpenWeatherMap decodes an OpenWeatherMap current weather response.
+func parseOpenWeatherMap(r io.Reader) (Observation, error) {
+	var data owmResponse
+	err := decodeJSON(r, &data)
+	if _, partial := err.(schemaError); err != nil && !partial {
+		return Observation{}, err
+	}
+	return Observation{
+		StationID:     strconv.FormatInt(data.ID, 10),
+		ObservedAt:    epochTime(data.Dt),
+		Latitude:      data.Coord.Lat,
+		Longitude:     data.Coord.Lon,
+		Temperature:   data.Main.Temp,
+		FeelsLike:     data.Main.FeelsLike,
+		Humidity:      data.Main.Humidity,
+		Pressure:      data.Main.Pressure,
+		WindDirection: data.Wind.Deg,
+		WindSpeed:     data.Wind.Speed.convert(msToKph),
+
+		WindGust:   data.Wind.Gust.convert(msToKph),
+		Precip1hr:  data.Rain.OneHour,
+		Visibility: data.Visibility.convert(metersToKm),
+	}, err
+}
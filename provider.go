@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Observation is a provider-independent weather observation, in metric
+// units. Readings the provider didn't report are left invalid.
+type Observation struct {
+	StationID string
+	// ObservedAt is when the station took the observation, or zero if the
+	// provider doesn't say.
+	ObservedAt    time.Time
+	Latitude      reading
+	Longitude     reading
+	Temperature   reading // °C
+	FeelsLike     reading // °C
+	DewPoint      reading // °C
+	Humidity      reading // %
+	WindDirection reading // degrees
+	WindSpeed     reading // km/h
+	PrecipToday   reading // mm
+	Pressure      reading // mb
+
+	WindGust       reading // km/h
+	Precip1hr      reading // mm
+	Visibility     reading // km
+	UV             reading // UV index
+	SolarRadiation reading // W/m²
+
+	// Derived from the above by deriveMissing unless the provider
+	// reports them.
+	HeatIndex        reading // °C
+	WindChill        reading // °C
+	AbsoluteHumidity reading // g/m³
+
+	// Derived from successive PrecipToday readings by a rainTracker.
+	PrecipRate          reading // mm/h
+	PrecipLast24h       reading // mm
+	PrecipSinceMidnight reading // mm
+}
+
+// malformedFields returns the readings the provider gave a value for that
+// couldn't be parsed, by field name.
+func (obs Observation) malformedFields() map[string]string {
+	fields := map[string]string{}
+	v := reflect.ValueOf(obs)
+	for i := 0; i < v.NumField(); i++ {
+		if r, ok := v.Field(i).Interface().(reading); ok && r.malformed != "" {
+			fields[v.Type().Field(i).Name] = r.malformed
+		}
+	}
+	return fields
+}
+
+// Provider fetches current observations from a weather service.
+type Provider interface {
+	// Name is the provider's name as given in the config, used in logs.
+	Name() string
+	Observe(ctx context.Context, stationID string) (Observation, error)
+}
+
+// localProvider is implemented by providers that read from the local network
+// rather than a rate limited API, and may be polled more often.
+type localProvider interface {
+	local() bool
+}
+
+// minProviderInterval returns the shortest poll interval accepted for p.
+func minProviderInterval(p Provider) time.Duration {
+	if l, ok := p.(localProvider); ok && l.local() {
+		return minLocalInterval
+	}
+	return minInterval
+}
+
+// providerOptions holds the settings used to construct a Provider.
+type providerOptions struct {
+	apiKey      string
+	baseURL     string
+	httpTimeout time.Duration
+
+	// transport makes the requests of the providers, or
+	// http.DefaultTransport if nil.
+	transport http.RoundTripper
+
+	// limiter, if set, is shared by every provider to stay within the API
+	// call budget.
+	limiter *apiLimiter
+
+	// uploads receives observations for the pws provider, and is nil
+	// unless -listen-pws or -listen-tempest is set.
+	uploads *uploadStore
+
+	// location is where the openmeteo provider reports the weather of.
+	location *geoArea
+}
+
+// newProvider returns the named provider. Each call creates its own HTTP
+// client, so a hung request for one station can't block another.
+func newProvider(name string, opts providerOptions) (Provider, error) {
+	if name == "pws" {
+		if opts.uploads == nil {
+			return nil, fmt.Errorf("the pws provider requires -listen-pws or -listen-tempest")
+		}
+		return &pws{opts.uploads}, nil
+	}
+	if name == "openmeteo" {
+		// Open-Meteo needs no API key, but is rate limited all the same.
+		return newOpenMeteo(newProviderClient(opts), opts)
+	}
+	if opts.apiKey == "" {
+		return nil, fmt.Errorf("no API key configured")
+	}
+	httpClient := newProviderClient(opts)
+	switch name {
+	case "wunderground":
+		return newWunderground(httpClient, opts), nil
+	case "openweathermap":
+		return newOpenWeatherMap(httpClient, opts), nil
+	case "weathercom":
+		return newWeatherCom(httpClient, opts), nil
+	}
+	return nil, fmt.Errorf("unknown provider %q, expected wunderground, openweathermap, weathercom, openmeteo or pws", name)
+}
+
+func newProviderClient(opts providerOptions) *http.Client {
+	transport := opts.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &http.Client{Timeout: opts.httpTimeout, Transport: transport}
+}
+
+// permanentError is returned for failures that retrying won't fix, such as
+// an invalid API key or an unknown station.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+// retryable reports whether a failed fetch is worth retrying.
+func retryable(err error) bool {
+	_, permanent := err.(permanentError)
+	// Retrying once the daily API budget is used up would only use it up
+	// again as soon as it refills.
+	return !permanent && !errors.Is(err, errQuotaExhausted)
+}
+
+// schemaError is returned by parsers along with a partial observation when
+// some of the response was not of the expected type, such as after a change
+// of the provider's schema.
+type schemaError struct {
+	err error
+}
+
+func (e schemaError) Error() string { return e.err.Error() }
+
+// decodeJSON decodes r into v, returning a schemaError if v could still be
+// partially filled in.
+func decodeJSON(r io.Reader, v interface{}) error {
+	err := json.NewDecoder(r).Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return schemaError{fmt.Errorf("unexpected JSON %s for %s", typeErr.Value, typeErr.Field)}
+	} else if err != nil {
+		return fmt.Errorf("failed to decode JSON: %v", err)
+	}
+	return nil
+}
+
+// Response bodies are read up to maxResponseSize, and up to maxLoggedPayload
+// of them is logged when they can't be parsed.
+const (
+	maxResponseSize  = 1 << 20
+	maxLoggedPayload = 2048
+)
+
+// loggedPayload returns b for logging, truncated to maxLoggedPayload.
+func loggedPayload(b []byte) string {
+	if len(b) > maxLoggedPayload {
+		return string(b[:maxLoggedPayload]) + "..."
+	}
+	return string(b)
+}
+
+// get performs an HTTP GET and parses the response body with parse, checking
+// that the observation is from the requested station. A partial observation
+// is returned if only some of the response matched the expected schema.
+func get(ctx context.Context, httpClient *http.Client, url string, stationID string, parse func(io.Reader) (Observation, error)) (Observation, error) {
+	var obs Observation
+	err := getJSON(ctx, httpClient, url, func(r io.Reader) error {
+		body, err := ioutil.ReadAll(io.LimitReader(r, maxResponseSize))
+		if err != nil {
+			return fmt.Errorf("failed to read response: %v", err)
+		}
+		obs, err = parse(bytes.NewReader(body))
+		if _, partial := err.(schemaError); partial {
+			slog.Warn("Response doesn't match the expected schema, using what could be parsed", "station", stationID, "err", err, "payload", loggedPayload(body))
+			return nil
+		} else if err != nil {
+			slog.Warn("Failed to parse response", "station", stationID, "err", err, "payload", loggedPayload(body))
+		} else if fields := obs.malformedFields(); len(fields) > 0 {
+			slog.Debug("Response has unparsable fields", "station", stationID, "payload", loggedPayload(body))
+		}
+		return err
+	})
+	if err != nil {
+		return Observation{}, err
+	}
+	if obs.StationID != stationID {
+		return Observation{}, fmt.Errorf("unexpected station in response: %q", obs.StationID)
+	}
+	return obs, nil
+}
+
+// getJSON performs an HTTP GET and passes the response body to parse.
+func getJSON(ctx context.Context, httpClient *http.Client, url string, parse func(io.Reader) error) (err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	ctx, span := tracer.Start(ctx, "HTTP GET",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", "GET"),
+			attribute.String("server.address", req.URL.Hostname()),
+		))
+	// The URL isn't recorded, as it may hold the API key.
+	defer func() { endSpan(span, err) }()
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to perform HTTP GET: %v", err)
+	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+	if res.StatusCode != 200 {
+		err = fmt.Errorf("failed to perform HTTP GET: %s", res.Status)
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			err = permanentError{err}
+		}
+		return err
+	}
+	_, decode := tracer.Start(ctx, "decode")
+	err = parse(res.Body)
+	endSpan(decode, err)
+	return err
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func valid(v float64) reading { return reading{value: v, valid: true} }
+
+// diffObservations returns the fields of got that differ from want, with
+// readings compared to within rounding.
+func diffObservations(got Observation, want Observation) []string {
+	var diffs []string
+	g, w := reflect.ValueOf(got), reflect.ValueOf(want)
+	for i := 0; i < g.NumField(); i++ {
+		name := g.Type().Field(i).Name
+		gr, ok := g.Field(i).Interface().(reading)
+		if !ok {
+			if !reflect.DeepEqual(g.Field(i).Interface(), w.Field(i).Interface()) {
+				diffs = append(diffs, name)
+			}
+			continue
+		}
+		wr := w.Field(i).Interface().(reading)
+		if gr.valid != wr.valid || gr.malformed != wr.malformed || math.Abs(gr.value-wr.value) > 1e-9 {
+			diffs = append(diffs, name)
+		}
+	}
+	return diffs
+}
+
+func openFixture(t *testing.T, name string) io.Reader {
+	t.Helper()
+	b, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.NewReader(string(b))
+}
+
+func TestParseReading(t *testing.T) {
+	tests := []struct {
+		s    string
+		want reading
+	}{
+		{"21.5", valid(21.5)},
+		{"72%", valid(72)},
+		{"-9999", reading{}},
+		{"N/A", reading{}},
+		{"21.5 C", reading{malformed: "21.5 C"}},
+		// ParseFloat accepts these, but they aren't readings.
+		{"NaN", reading{malformed: "NaN"}},
+		{"Inf", reading{malformed: "Inf"}},
+		{"-Infinity", reading{malformed: "-Infinity"}},
+	}
+	for _, tt := range tests {
+		if got := parseReading(tt.s); got != tt.want {
+			t.Errorf("parseReading(%q) = %+v, want %+v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseObservations(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		parse   func(io.Reader) (Observation, error)
+		want    Observation
+	}{
+		{
+			name:    "wunderground",
+			fixture: "wunderground_conditions.json",
+			parse:   parseObservation,
+			want: Observation{
+				StationID:     "KCASANFR58",
+				ObservedAt:    time.Unix(1760000000, 0),
+				Latitude:      valid(37.773285),
+				Longitude:     valid(-122.417725),
+				Temperature:   valid(18.3),
+				FeelsLike:     valid(18.3),
+				DewPoint:      valid(13),
+				Humidity:      valid(72),
+				WindDirection: valid(270),
+				WindSpeed:     valid(11.3),
+				PrecipToday:   valid(3),
+				Pressure:      valid(1015),
+				UV:            valid(3),
+			},
+		},
+		{
+			name:    "wunderground sentinels and humidity without %",
+			fixture: "wunderground_conditions_bare_humidity.json",
+			parse:   parseObservation,
+			want: Observation{
+				StationID:  "KCASANFR58",
+				ObservedAt: time.Unix(1760000000, 0),
+				Humidity:   valid(55),
+				Pressure:   reading{malformed: `{"value": 1015}`},
+			},
+		},
+		{
+			name:    "weathercom",
+			fixture: "weathercom_current.json",
+			parse:   parseWeatherCom,
+			want: Observation{
+				StationID:      "KCASANFR58",
+				ObservedAt:     time.Unix(1760000000, 0),
+				Latitude:       valid(37.773285),
+				Longitude:      valid(-122.417725),
+				Temperature:    valid(18.3),
+				FeelsLike:      valid(18.3),
+				DewPoint:       valid(13.1),
+				Humidity:       valid(72),
+				WindDirection:  valid(270),
+				WindSpeed:      valid(11.3),
+				PrecipToday:    valid(2.5),
+				Pressure:       valid(1015.2),
+				WindGust:       valid(19.8),
+				HeatIndex:      valid(18.3),
+				WindChill:      valid(18.3),
+				UV:             valid(3),
+				SolarRadiation: valid(412.5),
+			},
+		},
+		{
+			name:    "openweathermap",
+			fixture: "openweathermap_weather.json",
+			parse:   parseOpenWeatherMap,
+			want: Observation{
+				StationID:     "2673730",
+				ObservedAt:    time.Unix(1760000000, 0),
+				Latitude:      valid(59.3293),
+				Longitude:     valid(18.0686),
+				Temperature:   valid(4.5),
+				FeelsLike:     valid(1.2),
+				Humidity:      valid(87),
+				Pressure:      valid(1008),
+				WindDirection: valid(200),
+				WindSpeed:     valid(18),
+				WindGust:      valid(36),
+				Precip1hr:     valid(0.3),
+				Visibility:    valid(8),
+			},
+		},
+		{
+			name:    "openmeteo",
+			fixture: "openmeteo_forecast.json",
+			parse:   parseOpenMeteo,
+			want: Observation{
+				ObservedAt:     time.Unix(1760432400, 0),
+				Latitude:       valid(59.33),
+				Longitude:      valid(18.07),
+				Temperature:    valid(11.2),
+				FeelsLike:      valid(9.5),
+				DewPoint:       valid(7.9),
+				Humidity:       valid(80),
+				WindDirection:  valid(230),
+				WindSpeed:      valid(14.4),
+				Pressure:       valid(1012.3),
+				WindGust:       valid(30.2),
+				Precip1hr:      valid(0.4),
+				PrecipToday:    valid(2.2),
+				Visibility:     valid(24),
+				UV:             valid(1.5),
+				SolarRadiation: valid(210),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse(openFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if diffs := diffObservations(got, tt.want); len(diffs) > 0 {
+				t.Errorf("fields %v differ:\ngot  %+v\nwant %+v", diffs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		parse   func(io.Reader) (Observation, error)
+		partial bool
+	}{
+		{"truncated JSON", `{"current_observation": {"temp_c": 1`, parseObservation, false},
+		{"not JSON", `<html>Service Unavailable</html>`, parseWeatherCom, false},
+		{"no observations", `{"observations": []}`, parseWeatherCom, false},
+		{"unexpected type", `{"id": "2673730", "main": {"temp": 4.5}}`, parseOpenWeatherMap, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obs, err := tt.parse(strings.NewReader(tt.body))
+			if err == nil {
+				t.Fatal("parse succeeded")
+			}
+			if _, partial := err.(schemaError); partial != tt.partial {
+				t.Errorf("got error %v, partial %v, want partial %v", err, partial, tt.partial)
+			}
+			if tt.partial && !obs.Temperature.valid {
+				t.Errorf("partial observation lost the temperature: %+v", obs)
+			}
+		})
+	}
+}
+
+func TestParseUpload(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *http.Request
+		want Observation
+	}{
+		{
+			name: "wunderground",
+			req: httptest.NewRequest("GET", "/weatherstation/updateweatherstation.php?"+url.Values{
+				"ID":           {"KCASANFR58"},
+				"dateutc":      {"now"},
+				"tempf":        {"68"},
+				"humidity":     {"50"},
+				"windspeedmph": {"10"},
+				"baromin":      {"29.92"},
+				"dailyrainin":  {"-9999"},
+				"rainin":       {"0.1"},
+				"UV":           {"4"},
+			}.Encode(), nil),
+			want: Observation{
+				StationID:   "KCASANFR58",
+				Temperature: valid(20),
+				Humidity:    valid(50),
+				WindSpeed:   valid(10 * 1.609344),
+				Pressure:    valid(1013.207888),
+				Precip1hr:   valid(2.54),
+				UV:          valid(4),
+			},
+		},
+		{
+			name: "ecowitt",
+			req: func() *http.Request {
+				r := httptest.NewRequest("POST", "/data/report/", strings.NewReader(url.Values{
+					"PASSKEY":      {"0123456789ABCDEF"},
+					"dateutc":      {"2026-10-14 12:00:00"},
+					"tempf":        {"68"},
+					"baromrelin":   {"29.92"},
+					"hourlyrainin": {"0.1"},
+					"uv":           {"4"},
+				}.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			}(),
+			want: Observation{
+				StationID:   "0123456789ABCDEF",
+				ObservedAt:  time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC),
+				Temperature: valid(20),
+				Pressure:    valid(1013.207888),
+				Precip1hr:   valid(2.54),
+				UV:          valid(4),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploads := newUploadStore()
+			w := httptest.NewRecorder()
+			uploads.handler().ServeHTTP(w, tt.req)
+			u, ok := uploads.get(tt.want.StationID)
+			if !ok {
+				t.Fatalf("upload not stored, got %d %s", w.Code, w.Body)
+			}
+			if diffs := diffObservations(u.obs, tt.want); len(diffs) > 0 {
+				t.Errorf("fields %v differ:\ngot  %+v\nwant %+v", diffs, u.obs, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserveHTTP(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		fixture   string
+		body      string
+		stationID string
+		wantErr   bool
+		retryable bool
+	}{
+		{name: "ok", status: 200, fixture: "wunderground_conditions.json", stationID: "KCASANFR58"},
+		{name: "sentinels", status: 200, fixture: "wunderground_conditions_bare_humidity.json", stationID: "KCASANFR58"},
+		{name: "other station", status: 200, fixture: "wunderground_conditions.json", stationID: "KOTHER1", wantErr: true, retryable: true},
+		{name: "not JSON", status: 200, body: "<html>Service Unavailable</html>", stationID: "KCASANFR58", wantErr: true, retryable: true},
+		{name: "unauthorized", status: 401, stationID: "KCASANFR58", wantErr: true},
+		{name: "unknown station", status: 404, stationID: "KCASANFR58", wantErr: true},
+		{name: "rate limited", status: 429, stationID: "KCASANFR58", wantErr: true, retryable: true},
+		{name: "server error", status: 500, stationID: "KCASANFR58", wantErr: true, retryable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if tt.fixture != "" {
+				b, err := io.ReadAll(openFixture(t, tt.fixture))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+			}
+			var path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(tt.status)
+				io.WriteString(w, body)
+			}))
+			defer srv.Close()
+			p, err := newProvider("wunderground", providerOptions{apiKey: "key", baseURL: srv.URL, httpTimeout: 5 * time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			obs, err := p.Observe(context.Background(), tt.stationID)
+			if want := "/api/key/conditions/q/pws:" + tt.stationID + ".json"; path != want {
+				t.Errorf("requested %s, want %s", path, want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if retryable(err) != tt.retryable {
+					t.Errorf("error %v retryable %v, want %v", err, retryable(err), tt.retryable)
+				}
+				return
+			}
+			if obs.StationID != tt.stationID || !obs.Humidity.valid {
+				t.Errorf("unexpected observation %+v", obs)
+			}
+		})
+	}
+}
+
+func TestObserveQuotaExhausted(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		io.Copy(w, openFixture(t, "wunderground_conditions.json"))
+	}))
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	p, err := newProvider("wunderground", providerOptions{apiKey: "key", baseURL: srv.URL, limiter: newAPILimiterOn(clk, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Observe(context.Background(), "KCASANFR58"); err != nil {
+		t.Fatalf("call within the budget: %v", err)
+	}
+	if _, err := p.Observe(context.Background(), "KCASANFR58"); err == nil || retryable(err) {
+		t.Errorf("call over the budget returned %v, want a permanent error", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1", requests)
+	}
+}
+
+func TestObservePWSAge(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	uploads := newUploadStore()
+	uploads.clock = clk
+	uploads.put(Observation{StationID: "KX1", Temperature: valid(20)})
+	p := &pws{uploads}
+	clk.advance(pwsMaxAge)
+	if obs, err := p.Observe(context.Background(), "KX1"); err != nil || !obs.Temperature.valid {
+		t.Fatalf("upload %v old: %+v, %v", pwsMaxAge, obs, err)
+	}
+	clk.advance(time.Second)
+	if _, err := p.Observe(context.Background(), "KX1"); err == nil {
+		t.Error("upload older than pwsMaxAge was reported")
+	}
+}
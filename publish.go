@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Publisher sends messages to MQTT. It is implemented by publishLimiter, and
+// can be replaced by a fake to test what gets published.
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{})
+}
+
+// messageProperties are sent along with publishes over MQTT 5, and ignored
+// over MQTT 3.1.1.
+type messageProperties struct {
+	// expiry is the message expiry interval of retained publishes, after
+	// which the broker drops them. Zero keeps them forever.
+	expiry time.Duration
+	user   []userProperty
+	// trace, if valid, is the span that publishes are traced as part of.
+	// It isn't sent to the broker.
+	trace trace.SpanContext
+}
+
+type userProperty struct {
+	key   string
+	value string
+}
+
+// propertyPublisher is implemented by publishers that can send message
+// properties.
+type propertyPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props messageProperties)
+}
+
+type withPropertiesPublisher struct {
+	pub   propertyPublisher
+	props messageProperties
+}
+
+func (w withPropertiesPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) {
+	w.pub.PublishWithProperties(topic, qos, retained, payload, w.props)
+}
+
+// withProperties returns a Publisher sending props with every publish made
+// through pub, if pub supports it.
+func withProperties(pub Publisher, props messageProperties) Publisher {
+	if p, ok := pub.(propertyPublisher); ok {
+		return withPropertiesPublisher{p, props}
+	}
+	return pub
+}
+
+type publishRequest struct {
+	topic      string
+	qos        byte
+	retained   bool
+	payload    interface{}
+	properties messageProperties
+}
+
+// publishLimiter paces outgoing MQTT publishes from all stations so that a
+// burst of updates doesn't flood a slow broker. Publishes that arrive faster
+// than the configured rate are queued, and dropped once the queue is full.
+type publishLimiter struct {
+	conn     mqttConn
+	clock    clock
+	interval time.Duration
+	queue    chan publishRequest
+	done     chan struct{}
+
+	// mu is held for reading while publishing, so that close waits for
+	// publishes in progress.
+	mu      sync.RWMutex
+	closed  bool
+	pending sync.WaitGroup
+
+	// offline holds up to offlineSize publishes made while the broker is
+	// unreachable, which are sent once it reconnects. flushing is set
+	// while they are sent, so that newer publishes queue up behind them.
+	offlineMu   sync.Mutex
+	offline     []publishRequest
+	offlineSize int
+	flushing    bool
+}
+
+// newPublishLimiter returns a limiter allowing at most rate publishes per
+// second, buffering up to buffer publishes. A rate of zero disables limiting.
+// Up to offline publishes are kept while the broker is unreachable.
+func newPublishLimiter(conn mqttConn, rate float64, buffer int, offline int) *publishLimiter {
+	return newPublishLimiterOn(systemClock{}, conn, rate, buffer, offline)
+}
+
+// newPublishLimiterOn is newPublishLimiter, pacing publishes by c.
+func newPublishLimiterOn(c clock, conn mqttConn, rate float64, buffer int, offline int) *publishLimiter {
+	p := &publishLimiter{conn: conn, clock: c, done: make(chan struct{}), offlineSize: offline}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+		p.queue = make(chan publishRequest, buffer)
+		go p.run()
+	} else {
+		close(p.done)
+	}
+	return p
+}
+
+func (p *publishLimiter) Publish(topic string, qos byte, retained bool, payload interface{}) {
+	p.PublishWithProperties(topic, qos, retained, payload, messageProperties{})
+}
+
+func (p *publishLimiter) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props messageProperties) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		slog.Debug("Shutting down, dropping message", "topic", topic)
+		return
+	}
+	req := publishRequest{topic, qos, retained, payload, props}
+	if p.queue == nil {
+		p.send(req)
+		return
+	}
+	select {
+	case p.queue <- req:
+	default:
+		slog.Warn("Publish queue full, dropping message", "topic", topic)
+		publishThrottled.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (p *publishLimiter) run() {
+	defer close(p.done)
+	next := p.clock.now()
+	for req := range p.queue {
+		if now := p.clock.now(); now.Before(next) {
+			publishThrottled.WithLabelValues("delayed").Inc()
+			sleepOn(context.Background(), p.clock, next.Sub(now))
+			next = next.Add(p.interval)
+		} else {
+			next = now.Add(p.interval)
+		}
+		p.send(req)
+	}
+}
+
+// publishTimeout is how long to wait for the broker to acknowledge a publish
+// before counting it as failed.
+const publishTimeout = 30 * time.Second
+
+// close stops accepting publishes, and waits up to timeout for queued and
+// in-flight publishes to complete. It reports whether they all did.
+func (p *publishLimiter) close(timeout time.Duration) bool {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		if p.queue != nil {
+			close(p.queue)
+		}
+	}
+	p.mu.Unlock()
+	defer func() {
+		p.offlineMu.Lock()
+		defer p.offlineMu.Unlock()
+		if len(p.offline) > 0 {
+			slog.Warn("Dropping messages buffered while disconnected", "messages", len(p.offline))
+			offlineBuffered.Sub(float64(len(p.offline)))
+			p.offline = nil
+		}
+	}()
+
+	flushed := make(chan struct{})
+	go func() {
+		<-p.done
+		p.pending.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// send publishes req without waiting for it to complete, and counts it in
+// publishErrors if it fails. It is buffered instead while the broker is
+// unreachable.
+func (p *publishLimiter) send(req publishRequest) {
+	if p.offlineSize > 0 {
+		p.offlineMu.Lock()
+		hold := p.flushing || len(p.offline) > 0 || !p.conn.isConnected()
+		if hold {
+			p.hold(req)
+		}
+		p.offlineMu.Unlock()
+		if hold {
+			return
+		}
+	}
+	p.sendNow(req)
+}
+
+// hold adds req to the offline buffer, dropping the oldest publish if it is
+// full. p.offlineMu must be held.
+func (p *publishLimiter) hold(req publishRequest) {
+	if len(p.offline) >= p.offlineSize {
+		slog.Warn("Offline buffer full, dropping oldest message", "topic", p.offline[0].topic)
+		publishErrors.Inc()
+		p.offline = p.offline[1:]
+	} else {
+		offlineBuffered.Inc()
+	}
+	p.offline = append(p.offline, req)
+	// Such as when a publish failed just before reconnecting.
+	if !p.flushing && p.conn.isConnected() {
+		go p.flushOffline()
+	}
+}
+
+// retry buffers req, which failed because the connection was lost, unless a
+// newer publish to the same topic is already buffered.
+func (p *publishLimiter) retry(req publishRequest) {
+	p.offlineMu.Lock()
+	defer p.offlineMu.Unlock()
+	for _, r := range p.offline {
+		if r.topic == req.topic {
+			return
+		}
+	}
+	p.hold(req)
+}
+
+// flushOffline sends the publishes buffered while the broker was unreachable,
+// paced by the rate limit. It is called on every reconnect.
+func (p *publishLimiter) flushOffline() {
+	p.offlineMu.Lock()
+	if p.flushing || len(p.offline) == 0 {
+		p.offlineMu.Unlock()
+		return
+	}
+	p.flushing = true
+	slog.Info("Sending messages buffered while disconnected", "messages", len(p.offline))
+	p.offlineMu.Unlock()
+	for {
+		p.offlineMu.Lock()
+		if len(p.offline) == 0 || !p.conn.isConnected() {
+			p.flushing = false
+			p.offlineMu.Unlock()
+			return
+		}
+		req := p.offline[0]
+		p.offline = p.offline[1:]
+		offlineBuffered.Dec()
+		p.offlineMu.Unlock()
+		p.mu.RLock()
+		if !p.closed {
+			p.sendNow(req)
+		}
+		p.mu.RUnlock()
+		sleepOn(context.Background(), p.clock, p.interval)
+	}
+}
+
+func (p *publishLimiter) sendNow(req publishRequest) {
+	p.pending.Add(1)
+	var span trace.Span
+	if req.properties.trace.IsValid() {
+		_, span = tracer.Start(trace.ContextWithSpanContext(context.Background(), req.properties.trace), "publish",
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.system", "mqtt"),
+				attribute.String("messaging.destination.name", req.topic),
+			))
+	}
+	wait := p.conn.publish(req)
+	go func() {
+		defer p.pending.Done()
+		err := wait(publishTimeout)
+		if err != nil && p.offlineSize > 0 && !p.conn.isConnected() {
+			slog.Debug("Publish failed while disconnected, buffering it", "topic", req.topic, "err", err)
+			p.retry(req)
+		} else if err != nil {
+			slog.Warn("Publish failed", "topic", req.topic, "err", err)
+			publishErrors.Inc()
+		}
+		if span != nil {
+			endSpan(span, err)
+		}
+	}()
+}
+
+type publishedValue struct {
+	value interface{}
+	at    time.Time
+}
+
+// changeFilter remembers the last value published to each property of a
+// station, so that unchanged values are only republished every heartbeat.
+// Numeric values that moved less than the deadband of their property count
+// as unchanged. A zero heartbeat lets every value through.
+type changeFilter struct {
+	heartbeat time.Duration
+	deadbands map[string]float64
+	clock     clock
+	last      map[string]publishedValue
+}
+
+func newChangeFilter(heartbeat time.Duration, deadbands map[string]float64, clk clock) *changeFilter {
+	return &changeFilter{heartbeat: heartbeat, deadbands: deadbands, clock: clk, last: map[string]publishedValue{}}
+}
+
+// forget clears the recorded values, so that every value is published again,
+// and returns the properties that had been published.
+func (f *changeFilter) forget() []string {
+	var properties []string
+	for property := range f.last {
+		properties = append(properties, property)
+	}
+	f.last = map[string]publishedValue{}
+	return properties
+}
+
+// shouldPublish reports whether value should be published to property, and
+// if so records it as published.
+func (f *changeFilter) shouldPublish(property string, value interface{}) bool {
+	now := f.clock.now()
+	if prev, ok := f.last[property]; ok && f.heartbeat > 0 && f.unchanged(property, prev.value, value) && now.Sub(prev.at) < f.heartbeat {
+		return false
+	}
+	f.last[property] = publishedValue{value, now}
+	return true
+}
+
+// unchanged reports whether value is within the deadband of property from the
+// previously published value. Values are compared with the last published
+// one, so that slow drift is still published once it adds up.
+func (f *changeFilter) unchanged(property string, prev interface{}, value interface{}) bool {
+	if prev == value {
+		return true
+	}
+	p, ok1 := prev.(float64)
+	v, ok2 := value.(float64)
+	return ok1 && ok2 && math.Abs(v-p) < f.deadbands[property]
+}
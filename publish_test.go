@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeConn is an MQTT connection recording what is published on it.
+type fakeConn struct {
+	mu        sync.Mutex
+	connected bool
+	// err fails publishes, and drop disconnects as they fail.
+	err       error
+	drop      bool
+	published []publishRequest
+}
+
+func (c *fakeConn) publish(req publishRequest) func(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.err
+	if err == nil {
+		c.published = append(c.published, req)
+	} else if c.drop {
+		c.connected = false
+	}
+	return func(time.Duration) error { return err }
+}
+
+func (c *fakeConn) subscribe(filter string, handler func(topic string, payload []byte)) error {
+	return nil
+}
+
+func (c *fakeConn) isConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeConn) disconnect(timeout time.Duration) {}
+
+func (c *fakeConn) reconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected, c.err = true, nil
+}
+
+func (c *fakeConn) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var topics []string
+	for _, req := range c.published {
+		topics = append(topics, req.topic)
+	}
+	return topics
+}
+
+func TestPublishFailures(t *testing.T) {
+	lost := errors.New("connection lost")
+	tests := []struct {
+		name       string
+		conn       *fakeConn
+		wantSent   bool
+		wantErrors float64
+		wantHeld   int
+	}{
+		{"sent", &fakeConn{connected: true}, true, 0, 0},
+		{"failed while connected", &fakeConn{connected: true, err: lost}, false, 1, 0},
+		{"disconnected", &fakeConn{}, false, 0, 1},
+		{"disconnected while publishing", &fakeConn{connected: true, err: lost, drop: true}, false, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPublishLimiter(tt.conn, 0, 0, 10)
+			errorsBefore := testutil.ToFloat64(publishErrors)
+			p.Publish("wgd/KX1/temperature_degrees", 1, true, "21.5")
+			p.pending.Wait()
+			if got := len(tt.conn.topics()) == 1; got != tt.wantSent {
+				t.Errorf("sent %v, want %v", got, tt.wantSent)
+			}
+			if got := testutil.ToFloat64(publishErrors) - errorsBefore; got != tt.wantErrors {
+				t.Errorf("counted %v publish errors, want %v", got, tt.wantErrors)
+			}
+			p.offlineMu.Lock()
+			held := len(p.offline)
+			p.offlineMu.Unlock()
+			if held != tt.wantHeld {
+				t.Fatalf("buffered %d publishes, want %d", held, tt.wantHeld)
+			}
+			if held > 0 {
+				tt.conn.reconnect()
+				p.flushOffline()
+				p.pending.Wait()
+				if got := tt.conn.topics(); len(got) != 1 || got[0] != "wgd/KX1/temperature_degrees" {
+					t.Errorf("sent %v after reconnecting", got)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeFilter(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	f := newChangeFilter(30*time.Minute, map[string]float64{"temperature_degrees": 0.5}, clk)
+	steps := []struct {
+		after    time.Duration
+		property string
+		value    interface{}
+		want     bool
+	}{
+		{0, "temperature_degrees", 20.0, true},
+		{10 * time.Minute, "temperature_degrees", 20.4, false},
+		{0, "temperature_degrees", 20.5, true},
+		{0, "last_update", "2026-10-14T12:10:00Z", true},
+		{0, "last_update", "2026-10-14T12:10:00Z", false},
+		// Unchanged values are republished every heartbeat.
+		{29 * time.Minute, "temperature_degrees", 20.5, false},
+		{time.Minute, "temperature_degrees", 20.5, true},
+	}
+	for i, s := range steps {
+		clk.advance(s.after)
+		if got := f.shouldPublish(s.property, s.value); got != s.want {
+			t.Errorf("step %d: shouldPublish(%s, %v) = %v, want %v", i, s.property, s.value, got, s.want)
+		}
+	}
+	if got := f.forget(); len(got) != 2 {
+		t.Errorf("forget() = %v, want both properties", got)
+	}
+	if !f.shouldPublish("temperature_degrees", 20.5) {
+		t.Error("value not published again after forget")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// pwsMaxAge is how long an uploaded observation is reported before the
+// station is considered to have stopped uploading.
+const pwsMaxAge = 10 * time.Minute
+
+type upload struct {
+	obs Observation
+	at  time.Time
+}
+
+// uploadStore receives observations uploaded by weather station consoles
+// using the Weather Underground or Ecowitt protocols, and keeps the latest
+// one of each station.
+type uploadStore struct {
+	// clock times the uploads and tells their age, and is the system
+	// clock unless replaced by a test.
+	clock clock
+
+	mu     sync.Mutex
+	latest map[string]upload
+}
+
+func newUploadStore() *uploadStore {
+	return &uploadStore{clock: systemClock{}, latest: map[string]upload{}}
+}
+
+func (s *uploadStore) put(obs Observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[obs.StationID] = upload{obs, s.clock.now()}
+}
+
+func (s *uploadStore) get(stationID string) (upload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.latest[stationID]
+	return u, ok
+}
+
+// handler serves the upload endpoints: the Weather Underground
+// updateweatherstation.php GET protocol, and the Ecowitt POST protocol.
+func (s *uploadStore) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weatherstation/updateweatherstation.php", s.serveWunderground)
+	mux.HandleFunc("/data/report/", s.serveEcowitt)
+	return mux
+}
+
+func (s *uploadStore) serveWunderground(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("ID") == "" {
+		http.Error(w, "missing ID", http.StatusBadRequest)
+		return
+	}
+	obs := parseUpload(q.Get("ID"), q, "baromin", "rainin", "UV")
+	slog.Debug("Received Weather Underground upload", "station", obs.StationID)
+	s.put(obs)
+	fmt.Fprintln(w, "success")
+}
+
+func (s *uploadStore) serveEcowitt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Ecowitt consoles identify themselves only by their passkey.
+	if r.PostForm.Get("PASSKEY") == "" {
+		http.Error(w, "missing PASSKEY", http.StatusBadRequest)
+		return
+	}
+	obs := parseUpload(r.PostForm.Get("PASSKEY"), r.PostForm, "baromrelin", "hourlyrainin", "uv")
+	slog.Debug("Received Ecowitt upload", "station", obs.StationID)
+	s.put(obs)
+}
+
+// parseUpload converts the imperial upload parameters shared by both
+// protocols, which only differ in the names of the pressure, hourly rain and
+// UV index parameters.
+func parseUpload(stationID string, v url.Values, pressureKey string, rainKey string, uvKey string) Observation {
+	r := func(key string) reading { return parseReading(v.Get(key)) }
+	feelsLike := r("windchillf")
+	if !feelsLike.valid {
+		feelsLike = r("heatindexf")
+	}
+	// Consoles without a clock send "now".
+	var observedAt time.Time
+	if t, err := time.Parse("2006-01-02 15:04:05", v.Get("dateutc")); err == nil {
+		observedAt = t
+	}
+	return Observation{
+		StationID:      stationID,
+		ObservedAt:     observedAt,
+		Temperature:    r("tempf").convert(fahrenheitToCelsius),
+		FeelsLike:      feelsLike.convert(fahrenheitToCelsius),
+		DewPoint:       r("dewptf").convert(fahrenheitToCelsius),
+		Humidity:       r("humidity"),
+		WindDirection:  r("winddir"),
+		WindSpeed:      r("windspeedmph").convert(mphToKph),
+		WindGust:       r("windgustmph").convert(mphToKph),
+		PrecipToday:    r("dailyrainin").convert(inchesToMm),
+		Precip1hr:      r(rainKey).convert(inchesToMm),
+		Pressure:       r(pressureKey).convert(inHgToMb),
+		Visibility:     r("visibility").convert(milesToKm),
+		UV:             r(uvKey),
+		SolarRadiation: r("solarradiation"),
+	}
+}
+
+// pws reports the observations uploaded to the local listener. Ecowitt
+// stations are identified by their passkey.
+type pws struct {
+	uploads *uploadStore
+}
+
+func (p *pws) Name() string { return "pws" }
+
+func (p *pws) Observe(ctx context.Context, stationID string) (Observation, error) {
+	u, ok := p.uploads.get(stationID)
+	if !ok {
+		return Observation{}, fmt.Errorf("no upload received from station")
+	}
+	if age := p.uploads.clock.now().Sub(u.at); age > pwsMaxAge {
+		return Observation{}, fmt.Errorf("last upload was %v ago", age.Round(time.Second))
+	}
+	return u.obs, nil
+}
+
+func (p *pws) local() bool { return true }
@@ -0,0 +1,81 @@
+package main
+
+import "time"
+
+// rainSample is the rain that fell in the interval ending at at.
+type rainSample struct {
+	at time.Time
+	mm float64
+}
+
+// rainTracker derives the rain rate and rolling accumulations of a station
+// from its successive precipitation today readings. Windows are only
+// reported once the tracker has seen all of them, so a restart doesn't
+// report too little rain over the last 24 hours.
+type rainTracker struct {
+	// location is where midnight is, or the local timezone if nil.
+	location *time.Location
+
+	prev    float64
+	prevAt  time.Time
+	since   time.Time
+	samples []rainSample
+}
+
+// update fills in the rain rate, precipitation last 24 hours and since
+// midnight of obs, read at the given time, and the precipitation last hour
+// unless the provider reported it.
+func (t *rainTracker) update(obs *Observation, at time.Time) {
+	p := obs.PrecipToday
+	if !p.valid || p.value < 0 {
+		return
+	}
+	if t.prevAt.IsZero() || !at.After(t.prevAt) {
+		t.prev, t.prevAt, t.since = p.value, at, at
+		return
+	}
+	mm := p.value - t.prev
+	if mm < 0 {
+		// The daily counter was reset since the last reading, so all of
+		// today's rain fell in between.
+		mm = p.value
+	}
+	hours := at.Sub(t.prevAt).Hours()
+	t.prev, t.prevAt = p.value, at
+	t.samples = append(t.samples, rainSample{at, mm})
+	for len(t.samples) > 0 && !t.samples[0].at.After(at.Add(-24*time.Hour)) {
+		t.samples = t.samples[1:]
+	}
+
+	// A rate over a longer gap between readings says little about how
+	// hard it is raining now.
+	if hours <= 1 {
+		obs.PrecipRate = reading{value: mm / hours, valid: true}
+	}
+	if !obs.Precip1hr.valid && !at.Add(-time.Hour).Before(t.since) {
+		obs.Precip1hr = reading{value: t.sum(at.Add(-time.Hour)), valid: true}
+	}
+	if !at.Add(-24 * time.Hour).Before(t.since) {
+		obs.PrecipLast24h = reading{value: t.sum(at.Add(-24 * time.Hour)), valid: true}
+	}
+	location := t.location
+	if location == nil {
+		location = time.Local
+	}
+	local := at.In(location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	if !midnight.Before(t.since) {
+		obs.PrecipSinceMidnight = reading{value: t.sum(midnight), valid: true}
+	}
+}
+
+// sum returns the rain that fell after start.
+func (t *rainTracker) sum(start time.Time) float64 {
+	var mm float64
+	for _, s := range t.samples {
+		if s.at.After(start) {
+			mm += s.mm
+		}
+	}
+	return mm
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var apiQuotaRemaining = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "wgd2mqtt_api_quota_remaining",
+		Help: "Weather API calls left in the budget of -api-calls-per-minute or -api-calls-per-day",
+	},
+	[]string{"window"},
+)
+
+var apiThrottled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_api_calls_throttled_total",
+		Help: "Number of weather API calls delayed or skipped by the API rate limiter",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(apiQuotaRemaining)
+	prometheus.MustRegister(apiThrottled)
+}
+
+var errQuotaExhausted = errors.New("daily API call budget exhausted")
+
+// tokenBucket allows bursts of up to size calls, refilled evenly over per.
+type tokenBucket struct {
+	size   float64
+	tokens float64
+	rate   float64 // tokens per second
+	last   time.Time
+}
+
+func newTokenBucket(size int, per time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{float64(size), float64(size), float64(size) / per.Seconds(), now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.size, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// apiLimiter limits the calls made to the weather API by all stations
+// together. Calls beyond the per minute budget wait for it to refill, while
+// calls beyond the per day budget fail with errQuotaExhausted, as waiting
+// for that would take too long.
+type apiLimiter struct {
+	clock  clock
+	mu     sync.Mutex
+	minute *tokenBucket
+	day    *tokenBucket
+}
+
+// newAPILimiter returns a limiter for the given budgets, where zero is
+// unlimited, or nil if both are unlimited.
+func newAPILimiter(perMinute int, perDay int) *apiLimiter {
+	return newAPILimiterOn(systemClock{}, perMinute, perDay)
+}
+
+// newAPILimiterOn is newAPILimiter, refilling and waiting by c.
+func newAPILimiterOn(c clock, perMinute int, perDay int) *apiLimiter {
+	if perMinute <= 0 && perDay <= 0 {
+		return nil
+	}
+	l := &apiLimiter{clock: c}
+	if perMinute > 0 {
+		l.minute = newTokenBucket(perMinute, time.Minute, c.now())
+		apiQuotaRemaining.WithLabelValues("minute").Set(float64(perMinute))
+	}
+	if perDay > 0 {
+		l.day = newTokenBucket(perDay, 24*time.Hour, c.now())
+		apiQuotaRemaining.WithLabelValues("day").Set(float64(perDay))
+	}
+	return l
+}
+
+// wait takes a call from the budgets, waiting for the per minute budget if
+// needed. Providers call it before each request. A nil limiter doesn't
+// limit.
+func (l *apiLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	delayed := false
+	for {
+		l.mu.Lock()
+		now := l.clock.now()
+		if l.day != nil {
+			l.day.refill(now)
+			if l.day.tokens < 1 {
+				l.mu.Unlock()
+				apiThrottled.WithLabelValues("skipped").Inc()
+				return errQuotaExhausted
+			}
+		}
+		var delay time.Duration
+		if l.minute != nil {
+			l.minute.refill(now)
+			if l.minute.tokens < 1 {
+				delay = time.Duration((1 - l.minute.tokens) / l.minute.rate * float64(time.Second))
+			}
+		}
+		if delay == 0 {
+			l.take(l.minute, "minute")
+			l.take(l.day, "day")
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+		if !delayed {
+			delayed = true
+			apiThrottled.WithLabelValues("delayed").Inc()
+		}
+		if !sleepOn(ctx, l.clock, delay) {
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *apiLimiter) take(b *tokenBucket, window string) {
+	if b != nil {
+		b.tokens--
+		apiQuotaRemaining.WithLabelValues(window).Set(math.Floor(b.tokens))
+	}
+}
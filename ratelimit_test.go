@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAPILimiterWaitsForMinuteBudget(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	l := newAPILimiterOn(clk, 2, 0)
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("call %d within the budget: %v", i+1, err)
+		}
+	}
+	done := make(chan error)
+	go func() { done <- l.wait(context.Background()) }()
+	// Two calls a minute refill one token every 30s.
+	clk.waitForTimers(t, 1)
+	clk.advance(30 * time.Second)
+	if err := <-done; err != nil {
+		t.Errorf("call after the refill: %v", err)
+	}
+	if got := clk.now().Sub(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)); got != 30*time.Second {
+		t.Errorf("call waited %v, want 30s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- l.wait(ctx) }()
+	clk.waitForTimers(t, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait returned %v", err)
+	}
+}
+
+func TestAPILimiterDayBudget(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	l := newAPILimiterOn(clk, 0, 2)
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("call %d within the budget: %v", i+1, err)
+		}
+	}
+	if err := l.wait(context.Background()); err != errQuotaExhausted {
+		t.Fatalf("call over the budget returned %v, want errQuotaExhausted", err)
+	}
+	// A call is refilled every twelve hours.
+	clk.advance(12 * time.Hour)
+	if err := l.wait(context.Background()); err != nil {
+		t.Errorf("call after the refill: %v", err)
+	}
+}
+
+func TestNewAPILimiterUnlimited(t *testing.T) {
+	if l := newAPILimiter(0, 0); l != nil {
+		t.Errorf("got a limiter without budgets: %+v", l)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reading is a numeric observation field. Wunderground reports these either
+// as JSON numbers or as strings (humidity with a trailing "%"), and uses
+// "N/A", "--", "" or -9999 when the station has no value.
+type reading struct {
+	value float64
+	valid bool
+	// malformed is the value given if it was neither a number nor one of
+	// the markers for a missing value.
+	malformed string
+}
+
+func (r *reading) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	}
+	*r = parseReading(s)
+	return nil
+}
+
+// MarshalJSON encodes r as a number, or null if it is missing.
+func (r reading) MarshalJSON() ([]byte, error) {
+	if !r.valid {
+		return []byte("null"), nil
+	}
+	return json.Marshal(r.value)
+}
+
+// parseReading parses a reading given as a string, returning an invalid
+// reading for missing values. NaN and infinities are malformed, as no
+// provider means them as a value.
+func parseReading(s string) reading {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	switch s {
+	case "", "null", "N/A", "NA", "--", "-9999", "-999":
+		return reading{}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return reading{malformed: s}
+	}
+	if v != -9999 && v != -999 {
+		return reading{value: v, valid: true}
+	}
+	return reading{}
+}
+
+// validReading returns the value of r, and whether it is present and within
+// [min, max].
+func validReading(r reading, min float64, max float64) (float64, bool) {
+	if !r.valid || r.value < min || r.value > max {
+		return 0, false
+	}
+	return r.value, true
+}
+
+// epochTime returns the time of a reading of seconds since the epoch, or the
+// zero time if it is missing.
+func epochTime(r reading) time.Time {
+	if !r.valid || r.value <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(r.value), 0)
+}
+
+// convert returns r with its value converted by f.
+func (r reading) convert(f func(float64) float64) reading {
+	if r.valid {
+		r.value = f(r.value)
+	}
+	return r
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteOptions holds the settings of the Prometheus remote-write sink.
+// A bearer token takes precedence over a username and password.
+type remoteWriteOptions struct {
+	url         string
+	username    string
+	password    string
+	bearerToken string
+	timeout     time.Duration
+	// batch is how many observations to gather metrics for before pushing
+	// them in one request.
+	batch int
+	// gatherer defaults to prometheus.DefaultGatherer.
+	gatherer prometheus.Gatherer
+}
+
+// remoteWriteMaxPending is how many batches of samples are kept while the
+// endpoint is failing, after which the oldest are dropped.
+const remoteWriteMaxPending = 10
+
+type remoteWriteLabel struct{ name, value string }
+
+type remoteWriteSeries struct {
+	labels []remoteWriteLabel
+	value  float64
+	ts     int64 // milliseconds since the epoch
+}
+
+// remoteWriteSink pushes every registered metric, the weather gauges as well
+// as the operational ones, to a Prometheus remote-write endpoint such as
+// Grafana Cloud or Mimir. It is for setups where nothing scrapes /metrics.
+type remoteWriteSink struct {
+	httpClient *http.Client
+	gatherer   prometheus.Gatherer
+	opts       remoteWriteOptions
+
+	mu        sync.Mutex
+	pending   []remoteWriteSeries
+	snapshots int
+}
+
+func newRemoteWriteSink(opts remoteWriteOptions) (*remoteWriteSink, error) {
+	if opts.batch < 1 {
+		return nil, fmt.Errorf("the remote-write batch size must be at least 1, got %d", opts.batch)
+	}
+	s := &remoteWriteSink{
+		httpClient: &http.Client{Timeout: opts.timeout},
+		gatherer:   opts.gatherer,
+		opts:       opts,
+	}
+	if s.gatherer == nil {
+		s.gatherer = prometheus.DefaultGatherer
+	}
+	return s, nil
+}
+
+func (s *remoteWriteSink) Name() string { return "remote_write" }
+
+// Write takes a snapshot of the metrics, which already include the values
+// of the observation, and pushes the snapshots once a batch is complete.
+func (s *remoteWriteSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	// Timestamped under the lock, so that samples stay in order.
+	series := remoteWriteSamples(families, time.Now())
+	s.pending = append(s.pending, series...)
+	s.snapshots++
+	if s.snapshots > remoteWriteMaxPending*s.opts.batch {
+		// Drop the oldest snapshot, which is as long as the current one
+		// unless metrics were added or removed since.
+		drop := len(series)
+		if drop > len(s.pending)-len(series) {
+			drop = len(s.pending) - len(series)
+		}
+		s.pending = s.pending[drop:]
+		s.snapshots--
+	}
+	if s.snapshots < s.opts.batch {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	return s.flush()
+}
+
+// flush pushes the pending samples. They are kept for the next attempt if
+// the push fails.
+func (s *remoteWriteSink) flush() error {
+	s.mu.Lock()
+	batch, snapshots := s.pending, s.snapshots
+	s.pending, s.snapshots = nil, 0
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := s.push(batch); err != nil {
+		s.mu.Lock()
+		s.pending = append(batch, s.pending...)
+		s.snapshots += snapshots
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *remoteWriteSink) push(series []remoteWriteSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequest("POST", s.opts.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if s.opts.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.bearerToken)
+	} else if s.opts.username != "" {
+		req.SetBasicAuth(s.opts.username, s.opts.password)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// remoteWriteSamples flattens metric families into one series per sample,
+// naming histogram and summary components as the text exposition does.
+func remoteWriteSamples(families []*dto.MetricFamily, now time.Time) []remoteWriteSeries {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	var series []remoteWriteSeries
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			add := func(name string, value float64, extra ...remoteWriteLabel) {
+				labels := []remoteWriteLabel{{"__name__", name}}
+				for _, l := range m.GetLabel() {
+					labels = append(labels, remoteWriteLabel{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, remoteWriteSeries{labels, value, ts})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), remoteWriteLabel{"le", formatBound(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), remoteWriteLabel{"le", "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(name, q.GetValue(), remoteWriteLabel{"quantile", formatBound(q.GetQuantile())})
+				}
+				add(name+"_sum", sm.GetSampleSum())
+				add(name+"_count", float64(sm.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as a remote-write WriteRequest protobuf
+// message, which is small enough to not warrant the generated types. Samples
+// of the same series, from several snapshots, are sent as one time series.
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var order []string
+	grouped := map[string][]byte{}
+	for _, s := range series {
+		var key strings.Builder
+		for _, l := range s.labels {
+			key.WriteString(l.name + "\xff" + l.value + "\xff")
+		}
+		ts, ok := grouped[key.String()]
+		if !ok {
+			order = append(order, key.String())
+			for _, l := range s.labels {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, l.name)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, l.value)
+				ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, label)
+			}
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.ts))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		grouped[key.String()] = protowire.AppendBytes(ts, sample)
+	}
+	var req []byte
+	for _, key := range order {
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, grouped[key])
+	}
+	return req
+}
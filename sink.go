@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink is an additional output that observations are written to, alongside
+// MQTT and Prometheus. Values are keyed by property, as published to MQTT.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error
+}
+
+var sinkErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_sink_write_errors_total",
+		Help: "Number of failed writes to an output sink",
+	},
+	[]string{"sink"},
+)
+
+var sinkDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_sink_dropped_total",
+		Help: "Number of observations dropped because the queue of an output sink was full",
+	},
+	[]string{"sink"},
+)
+
+func init() {
+	prometheus.MustRegister(sinkErrors)
+	prometheus.MustRegister(sinkDropped)
+}
+
+// writeSinks writes values to every sink, logging and counting failures.
+func writeSinks(ctx context.Context, logger *slog.Logger, sinks []Sink, stationID string, at time.Time, values map[string]float64) {
+	for _, s := range sinks {
+		if err := s.Write(ctx, stationID, at, values); err != nil {
+			logger.Error("Failed to write to sink", "sink", s.Name(), "err", err)
+			sinkErrors.WithLabelValues(s.Name()).Inc()
+		}
+	}
+}
+
+type sinkWrite struct {
+	// deadline is that of the context the write was queued with, if any.
+	deadline  time.Time
+	stationID string
+	at        time.Time
+	values    map[string]float64
+}
+
+// sinkQueue writes observations to a sink from its own goroutine, so that a
+// slow or unreachable sink holds up neither the updaters nor the other
+// sinks. Up to size observations are queued, and the oldest is dropped to
+// make room once the queue is full.
+type sinkQueue struct {
+	sink Sink
+	size int
+	wake chan struct{}
+	done chan struct{}
+	// ctx is cancelled when close returns, to abort a write still in
+	// progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	queue  []sinkWrite
+	closed bool
+}
+
+// newSinkQueue returns a queue of up to size observations for s, written by
+// a goroutine that runs until the queue is closed.
+func newSinkQueue(s Sink, size int) *sinkQueue {
+	q := &sinkQueue{sink: s, size: size, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	go q.run()
+	return q
+}
+
+func (q *sinkQueue) Name() string { return q.sink.Name() }
+
+// Write queues values for the sink, to be written by the deadline of ctx.
+// Failures are logged and counted when the sink is written, so it always
+// returns nil.
+func (q *sinkQueue) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		slog.Debug("Shutting down, dropping observation", "sink", q.Name(), "station", stationID)
+		return nil
+	}
+	if len(q.queue) >= q.size {
+		dropped := q.queue[0]
+		q.queue = q.queue[1:]
+		slog.Warn("Sink queue full, dropping oldest observation", "sink", q.Name(), "station", dropped.stationID, "at", dropped.at)
+		sinkDropped.WithLabelValues(q.Name()).Inc()
+	}
+	deadline, _ := ctx.Deadline()
+	q.queue = append(q.queue, sinkWrite{deadline, stationID, at, values})
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			closed := q.closed
+			q.mu.Unlock()
+			if closed {
+				return
+			}
+			<-q.wake
+			continue
+		}
+		w := q.queue[0]
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		q.write(w)
+	}
+}
+
+func (q *sinkQueue) write(w sinkWrite) {
+	ctx, cancel := q.ctx, context.CancelFunc(func() {})
+	if !w.deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(q.ctx, w.deadline)
+	}
+	defer cancel()
+	writeSinks(ctx, slog.With("station", w.stationID), []Sink{q.sink}, w.stationID, w.at, w.values)
+}
+
+// close stops accepting observations, and waits up to timeout for the
+// queued ones to be written. It reports whether they all were.
+func (q *sinkQueue) close(timeout time.Duration) bool {
+	defer q.cancel()
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case <-q.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingSink records the stations written to it, each write waiting for
+// release once started has been signalled.
+type blockingSink struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	written []string
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+
+func (s *blockingSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	s.started <- struct{}{}
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, stationID)
+	return nil
+}
+
+func TestSinkQueueDropsOldest(t *testing.T) {
+	s := &blockingSink{started: make(chan struct{}, 10), release: make(chan struct{})}
+	q := newSinkQueue(s, 2)
+	q.Write(context.Background(), "KX1", time.Time{}, nil)
+	<-s.started
+	// KX1 is being written, so KX2 and KX3 fill the queue and KX4 drops
+	// KX2.
+	for _, id := range []string{"KX2", "KX3", "KX4"} {
+		q.Write(context.Background(), id, time.Time{}, nil)
+	}
+	close(s.release)
+	if !q.close(time.Second) {
+		t.Fatal("queued writes weren't written")
+	}
+	want := []string{"KX1", "KX3", "KX4"}
+	if !reflect.DeepEqual(s.written, want) {
+		t.Errorf("written %v, want %v", s.written, want)
+	}
+	if err := q.Write(context.Background(), "KX5", time.Time{}, nil); err != nil || len(s.written) != 3 {
+		t.Errorf("write after close went through: %v", s.written)
+	}
+}
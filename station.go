@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// stationIDPattern also allows dashes, as in Tempest serial numbers.
+var stationIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// station is a configured station with its settings resolved.
+type station struct {
+	id       string
+	alias    string
+	provider Provider
+	opts     updaterOptions
+
+	// config is what the station was built from, to tell whether it
+	// changed when the config is reloaded.
+	config stationConfig
+}
+
+// name returns the station's alias, or its ID if it has none.
+func (s station) name() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.id
+}
+
+// stationDefaults holds the settings of stations that don't override them.
+type stationDefaults struct {
+	provider     string
+	providerOpts providerOptions
+	opts         updaterOptions
+}
+
+// parseStations splits a comma separated list of station IDs, ignoring empty
+// entries.
+func parseStations(list string) []stationConfig {
+	var configs []stationConfig
+	for _, id := range strings.Split(list, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			configs = append(configs, stationConfig{ID: id})
+		}
+	}
+	return configs
+}
+
+// buildStations validates the configured stations and resolves their
+// settings, ignoring repeated station IDs.
+func buildStations(configs []stationConfig, defaults stationDefaults) ([]station, error) {
+	var stations []station
+	seen, aliases := map[string]bool{}, map[string]bool{}
+	for _, c := range configs {
+		if seen[c.ID] {
+			continue
+		}
+		if !stationIDPattern.MatchString(c.ID) {
+			return nil, fmt.Errorf("invalid station ID %q", c.ID)
+		}
+		seen[c.ID] = true
+
+		if c.Alias != "" {
+			if aliases[c.Alias] {
+				return nil, fmt.Errorf("%s: alias %q is used by another station", c.ID, c.Alias)
+			}
+			aliases[c.Alias] = true
+		}
+
+		s := station{id: c.ID, alias: c.Alias, opts: defaults.opts, config: c}
+		s.opts.alias, s.opts.labels = c.Alias, c.Labels
+		if area, ok := c.Labels["area"]; ok {
+			s.opts.area = area
+		}
+		if c.Alias != "" || len(c.Labels) > 0 {
+			s.opts.topics = s.opts.topics.forStation(c.Alias, c.Labels, s.opts.area)
+		}
+		if c.Interval != 0 {
+			s.opts.interval = c.Interval
+		}
+		if c.Jitter != 0 {
+			s.opts.jitter = c.Jitter
+		}
+		if c.Units != "" {
+			var err error
+			if s.opts.units, err = parseUnits(c.Units); err != nil {
+				return nil, fmt.Errorf("%s: %v", c.ID, err)
+			}
+		}
+
+		if c.Timezone != "" {
+			var err error
+			if s.opts.timezone, err = time.LoadLocation(c.Timezone); err != nil {
+				return nil, fmt.Errorf("%s: timezone: %v", c.ID, err)
+			}
+		}
+
+		if c.Payload != "" {
+			if err := s.opts.setPayloadMode(c.Payload); err != nil {
+				return nil, fmt.Errorf("%s: %v", c.ID, err)
+			}
+		}
+
+		providerName, providerOpts := defaults.provider, defaults.providerOpts
+		if c.Provider != "" {
+			providerName = c.Provider
+		}
+		if c.APIKey != "" {
+			providerOpts.apiKey = c.APIKey
+		}
+		if (c.Latitude == nil) != (c.Longitude == nil) {
+			return nil, fmt.Errorf("%s: latitude and longitude must be given together", c.ID)
+		}
+		if c.Latitude != nil {
+			if *c.Latitude < -90 || *c.Latitude > 90 || *c.Longitude < -180 || *c.Longitude > 180 {
+				return nil, fmt.Errorf("%s: %v,%v is not a valid location", c.ID, *c.Latitude, *c.Longitude)
+			}
+			providerOpts.location = &geoArea{lat: *c.Latitude, lon: *c.Longitude}
+		}
+		s.opts.location = providerOpts.location
+		var err error
+		if providerName == "virtual" {
+			s.provider, err = newVirtualProvider(defaults.opts.observed, c)
+		} else {
+			s.provider, err = newProvider(providerName, providerOpts)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.ID, err)
+		}
+		if min := minProviderInterval(s.provider); s.opts.interval < min {
+			return nil, fmt.Errorf("%s: interval %v is shorter than %v", c.ID, s.opts.interval, min)
+		}
+		if s.opts.jitter < 0 || s.opts.jitter >= s.opts.interval/2 {
+			return nil, fmt.Errorf("%s: jitter %v must be less than half of the interval", c.ID, s.opts.jitter)
+		}
+		stations = append(stations, s)
+	}
+	return stations, resolveMembers(stations)
+}
+
+// resolveMembers checks that the members of virtual stations are other,
+// real, stations, and defaults how long their observations are used for.
+func resolveMembers(stations []station) error {
+	byID := map[string]station{}
+	for _, s := range stations {
+		byID[s.id] = s
+	}
+	for _, s := range stations {
+		p, ok := s.provider.(*virtualProvider)
+		if !ok {
+			continue
+		}
+		var longest time.Duration
+		for _, id := range p.members {
+			m, ok := byID[id]
+			if !ok {
+				return fmt.Errorf("%s: member %q is not a configured station", s.id, id)
+			}
+			if _, virtual := m.provider.(*virtualProvider); virtual {
+				return fmt.Errorf("%s: member %q is itself a virtual station", s.id, id)
+			}
+			if m.opts.interval > longest {
+				longest = m.opts.interval
+			}
+		}
+		if p.maxAge == 0 {
+			p.maxAge = 2 * longest
+		}
+	}
+	return nil
+}
+
+// maxInterval returns the longest poll interval of any station.
+func maxInterval(stations []station) time.Duration {
+	var max time.Duration
+	for _, s := range stations {
+		if s.opts.interval > max {
+			max = s.opts.interval
+		}
+	}
+	return max
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	// Station timezones resolve even where the system has no zoneinfo,
+	// such as in the alpine image.
+	_ "time/tzdata"
+)
+
+// daySummary holds the statistics of a station over one local day, in metric
+// units.
+type daySummary struct {
+	date                 string
+	observations         int
+	tempMin, tempMax     reading
+	tempMinAt, tempMaxAt time.Time
+	windSum              float64
+	windCount            int
+	gustMax              reading
+	gustMaxAt            time.Time
+	precip               reading
+}
+
+// summaryTracker accumulates the daily summary of a station from the
+// observations fetched by its updater, starting a new day at midnight in
+// location.
+type summaryTracker struct {
+	mu       sync.Mutex
+	location *time.Location
+	today    daySummary
+	// prevPrecip is the last precipitation today read, as the total is
+	// accumulated from its increases so that it follows the local day
+	// rather than the provider's.
+	prevPrecip reading
+}
+
+func newSummaryTracker(location *time.Location) *summaryTracker {
+	if location == nil {
+		location = time.Local
+	}
+	return &summaryTracker{location: location}
+}
+
+func (s *summaryTracker) day(t time.Time) string {
+	return t.In(s.location).Format("2006-01-02")
+}
+
+// nextMidnight returns the start of the local day after that of t.
+func (s *summaryTracker) nextMidnight(t time.Time) time.Time {
+	y, m, d := t.In(s.location).Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, s.location)
+}
+
+// rollover starts the day of now if it is after the one being summarized,
+// returning the summary of the day that ended.
+func (s *summaryTracker) rollover(now time.Time) (daySummary, bool) {
+	day := s.day(now)
+	if s.today.date == "" || day <= s.today.date {
+		if s.today.date == "" {
+			s.today.date = day
+		}
+		return daySummary{}, false
+	}
+	ended := s.today
+	s.today = daySummary{date: day}
+	return ended, true
+}
+
+// add records obs, fetched at the given time, returning the summary of today
+// and that of yesterday if obs started a new day. Observations of a day
+// already summarized are ignored.
+func (s *summaryTracker) add(obs Observation, at time.Time) (today daySummary, yesterday daySummary, ended bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := obs.ObservedAt
+	if t.IsZero() {
+		t = at
+	}
+	yesterday, ended = s.rollover(t)
+	if s.day(t) < s.today.date {
+		return s.today, yesterday, ended
+	}
+
+	d := &s.today
+	d.observations++
+	if r := obs.Temperature; r.valid && r.value >= metricUnits.minTemperature && r.value <= metricUnits.maxTemperature {
+		if !d.tempMin.valid || r.value < d.tempMin.value {
+			d.tempMin, d.tempMinAt = r, t
+		}
+		if !d.tempMax.valid || r.value > d.tempMax.value {
+			d.tempMax, d.tempMaxAt = r, t
+		}
+	}
+	if r := obs.WindSpeed; r.valid && r.value >= 0 {
+		d.windSum += r.value
+		d.windCount++
+	}
+	if r := obs.WindGust; r.valid && (!d.gustMax.valid || r.value > d.gustMax.value) {
+		d.gustMax, d.gustMaxAt = r, t
+	}
+	if r := obs.PrecipToday; r.valid && r.value >= 0 {
+		mm := r.value
+		if s.prevPrecip.valid && r.value >= s.prevPrecip.value {
+			mm = r.value - s.prevPrecip.value
+		}
+		// Without an earlier reading, the provider's daily total is
+		// taken as what fell today so far.
+		d.precip = reading{value: d.precip.value + mm, valid: true}
+		s.prevPrecip = r
+	}
+	return s.today, yesterday, ended
+}
+
+// roll starts a new day if now is past midnight, returning the summary of the
+// day that ended.
+func (s *summaryTracker) roll(now time.Time) (today daySummary, yesterday daySummary, ended bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	yesterday, ended = s.rollover(now)
+	return s.today, yesterday, ended
+}
+
+// values returns the properties of the summary in each of us, with nil for
+// those not known yet.
+func (d daySummary) values(us []units) map[string]interface{} {
+	timestamp := func(r reading, t time.Time) interface{} {
+		if !r.valid {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	values := map[string]interface{}{
+		"date":               d.date,
+		"observations":       d.observations,
+		"temperature_min_at": timestamp(d.tempMin, d.tempMinAt),
+		"temperature_max_at": timestamp(d.tempMax, d.tempMaxAt),
+		"wind_gust_max_at":   timestamp(d.gustMax, d.gustMaxAt),
+	}
+	value := func(r reading, convert func(float64) float64) interface{} {
+		if !r.valid {
+			return nil
+		}
+		return math.Round(convert(r.value)*100) / 100
+	}
+	var wind reading
+	if d.windCount > 0 {
+		wind = reading{value: d.windSum / float64(d.windCount), valid: true}
+	}
+	for _, u := range us {
+		temperature := strings.TrimPrefix(u.temperatureTopic, "temperature_")
+		speed := strings.TrimPrefix(u.windSpeedTopic, "wind_")
+		precip := strings.TrimPrefix(u.precipTopic, "precip_today_")
+		values["temperature_min_"+temperature] = value(d.tempMin, u.convertTemperature)
+		values["temperature_max_"+temperature] = value(d.tempMax, u.convertTemperature)
+		values["wind_avg_"+speed] = value(wind, u.convertSpeed)
+		values["wind_gust_max_"+speed] = value(d.gustMax, u.convertSpeed)
+		values["precip_total_"+precip] = value(d.precip, u.convertPrecip)
+	}
+	return values
+}
+
+// summaryUpdater ends the day of s at each local midnight until ctx is
+// cancelled, so that yesterday's summary is published even if no
+// observation is fetched after midnight.
+func summaryUpdater(ctx context.Context, logger *slog.Logger, stationID string, s *summaryTracker, clk clock, opts updaterOptions, pub Publisher) {
+	for {
+		now := clk.now()
+		t, stop := clk.timer(s.nextMidnight(now).Sub(now) + time.Second)
+		select {
+		case <-ctx.Done():
+			stop()
+			return
+		case <-t:
+		}
+		stop()
+		if today, yesterday, ended := s.roll(clk.now()); ended {
+			publishSummary(logger, pub, stationID, today, &yesterday, opts)
+		}
+	}
+}
+
+// publishSummary publishes each value of today to .../summary/today/<property>,
+// clearing those not known yet, and all of them as JSON to .../summary/today.
+// A summary of yesterday is published as retained JSON to
+// .../summary/yesterday.
+func publishSummary(logger *slog.Logger, pub Publisher, stationID string, today daySummary, yesterday *daySummary, opts updaterOptions) {
+	if yesterday != nil {
+		logger.Info("Publishing daily summary", "date", yesterday.date, "observations", yesterday.observations)
+		payload, err := json.Marshal(known(yesterday.values(opts.units)))
+		if err != nil {
+			logger.Error("Failed to encode daily summary", "err", err)
+		} else {
+			qos, _ := opts.publishFlags("summary", opts.qos, true)
+			pub.Publish(opts.topics.topic(stationID, "summary/yesterday"), qos, true, payload)
+		}
+	}
+
+	qos, retain := opts.publishFlags("summary", opts.qos, opts.retain)
+	values := today.values(opts.units)
+	if opts.publishProperties {
+		for property, value := range values {
+			payload := ""
+			if value != nil {
+				payload = fmt.Sprint(value)
+			}
+			pub.Publish(opts.topics.topic(stationID, "summary/today/"+property), qos, retain, payload)
+		}
+	}
+	payload, err := json.Marshal(known(values))
+	if err != nil {
+		logger.Error("Failed to encode daily summary", "err", err)
+		return
+	}
+	pub.Publish(opts.topics.topic(stationID, "summary/today"), qos, retain, payload)
+}
+
+// known returns values without those that are nil.
+func known(values map[string]interface{}) map[string]interface{} {
+	for property, value := range values {
+		if value == nil {
+			delete(values, property)
+		}
+	}
+	return values
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+)
+
+type runningStation struct {
+	station station
+	cancel  context.CancelFunc
+	done    chan struct{}
+	// refresh requests a fetch ahead of schedule.
+	refresh chan struct{}
+}
+
+// supervisor runs an updater for each configured station, and starts and
+// stops them as the configuration is reloaded.
+type supervisor struct {
+	ctx context.Context
+	pub Publisher
+	h   *health
+
+	// onStart and onStop are called with a station as it is added or
+	// removed, such as to update its discovery configs.
+	onStart func(station)
+	onStop  func(station)
+
+	mu      sync.Mutex
+	running map[string]*runningStation
+	order   []string
+}
+
+func newSupervisor(ctx context.Context, pub Publisher, h *health) *supervisor {
+	return &supervisor{ctx: ctx, pub: pub, h: h, running: map[string]*runningStation{}}
+}
+
+// apply makes stations the running set. Stations whose settings didn't
+// change keep running, so they aren't fetched again early.
+func (s *supervisor) apply(stations []station) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wanted := map[string]station{}
+	for _, st := range stations {
+		wanted[st.id] = st
+	}
+	for id, r := range s.running {
+		if st, ok := wanted[id]; ok && reflect.DeepEqual(st.config, r.station.config) {
+			continue
+		}
+		r.cancel()
+		<-r.done
+		delete(s.running, id)
+		if _, ok := wanted[id]; !ok {
+			slog.Info("Station removed", "station", id)
+			s.h.forget(id)
+			if s.onStop != nil {
+				s.onStop(r.station)
+			}
+		}
+	}
+	s.order = s.order[:0]
+	for _, st := range stations {
+		s.order = append(s.order, st.id)
+		if _, ok := s.running[st.id]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		r := &runningStation{st, cancel, make(chan struct{}), make(chan struct{}, 1)}
+		s.running[st.id] = r
+		s.h.track(st.id)
+		go func() {
+			defer close(r.done)
+			updater(ctx, r.station.id, r.station.provider, r.station.opts, s.pub, s.h, r.refresh)
+		}()
+		slog.Debug("Station started", "station", st.id)
+		if s.onStart != nil {
+			s.onStart(st)
+		}
+	}
+	s.h.setMaxAge(2 * maxInterval(s.stationsLocked()))
+}
+
+// stations returns the running stations in configured order.
+func (s *supervisor) stations() []station {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stationsLocked()
+}
+
+func (s *supervisor) stationsLocked() []station {
+	var stations []station
+	for _, id := range s.order {
+		stations = append(stations, s.running[id].station)
+	}
+	return stations
+}
+
+// refresh requests an immediate fetch of a station, and reports whether it
+// is running. Requests made while one is pending are merged.
+func (s *supervisor) refresh(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.running[id]
+	if ok {
+		select {
+		case r.refresh <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// refreshAll requests an immediate fetch of every station.
+func (s *supervisor) refreshAll() {
+	for _, st := range s.stations() {
+		s.refresh(st.id)
+	}
+}
+
+// wait blocks until every updater has returned after ctx is cancelled.
+func (s *supervisor) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.running {
+		<-r.done
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends state to systemd, such as "READY=1", when running as a
+// Type=notify service. It does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ is an abstract socket.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects to hear from the
+// service, or zero if the watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd the service is ready once it is connected to
+// MQTT and has fetched a station, and then pets the watchdog for as long as
+// no updater is stalled, so that systemd restarts a wedged bridge.
+func notifySystemd(ctx context.Context, h *health) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog := watchdogInterval()
+	tick := time.Second
+	if watchdog > 0 && watchdog/2 < tick {
+		tick = watchdog / 2
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	ready := false
+	var lastPet time.Time
+	var stalled string
+	for {
+		if !ready && h.notReadyReason() == "" {
+			ready = true
+			if err := sdNotify("READY=1"); err != nil {
+				slog.Warn("Failed to notify systemd", "err", err)
+			}
+			slog.Debug("Notified systemd of readiness")
+		}
+		if watchdog > 0 && time.Since(lastPet) >= watchdog/2 {
+			was := stalled
+			if stalled = h.stalled(); stalled != "" {
+				if stalled != was {
+					slog.Error("Station updater stalled, no longer petting the systemd watchdog", "station", stalled)
+				}
+			} else if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Failed to notify systemd watchdog", "err", err)
+			} else {
+				lastPet = time.Now()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			return
+		case <-t.C:
+		}
+	}
+}
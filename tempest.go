@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// tempestMessage is a local UDP broadcast of a WeatherFlow hub. Only the
+// fields of the obs_st, rapid_wind and evt_precip messages are decoded.
+type tempestMessage struct {
+	SerialNumber string      `json:"serial_number"`
+	Type         string      `json:"type"`
+	Obs          [][]float64 `json:"obs"`
+	Ob           []float64   `json:"ob"`
+	Evt          []float64   `json:"evt"`
+}
+
+// Indexes into the obs_st observation array, which starts with the time
+// of the observation.
+const (
+	tempestWindAvg        = 2 // m/s
+	tempestWindGust       = 3 // m/s
+	tempestWindDirection  = 4 // degrees
+	tempestPressure       = 6 // mb, at station level
+	tempestTemperature    = 7 // °C
+	tempestHumidity       = 8 // %
+	tempestUV             = 10
+	tempestSolarRadiation = 11 // W/m²
+	tempestRain           = 12 // mm over the report interval
+	tempestObsLen         = 13
+)
+
+// tempestStation is what has been received from a single Tempest.
+type tempestStation struct {
+	obs Observation
+	// rainDay is the local date rainToday was accumulated on, as the
+	// Tempest reports rain per report interval only.
+	rainDay   string
+	rainToday float64
+}
+
+// tempestListener decodes the broadcasts of WeatherFlow hubs on the local
+// network into uploads for the pws provider, with the device serial number
+// (such as ST-00012345) as the station ID.
+type tempestListener struct {
+	uploads  *uploadStore
+	stations map[string]*tempestStation
+}
+
+func newTempestListener(uploads *uploadStore) *tempestListener {
+	return &tempestListener{uploads: uploads, stations: map[string]*tempestStation{}}
+}
+
+// listen receives broadcasts on addr until ctx is cancelled.
+func (l *tempestListener) listen(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("Tempest listener failed", "err", err)
+				}
+				return
+			}
+			var msg tempestMessage
+			if err := json.Unmarshal(buf[:n], &msg); err != nil {
+				slog.Debug("Ignoring undecodable Tempest broadcast", "err", err)
+				continue
+			}
+			l.handle(msg, time.Now())
+		}
+	}()
+	return nil
+}
+
+func (l *tempestListener) handle(msg tempestMessage, now time.Time) {
+	if msg.SerialNumber == "" {
+		return
+	}
+	st, ok := l.stations[msg.SerialNumber]
+	switch msg.Type {
+	case "obs_st":
+		if len(msg.Obs) == 0 || len(msg.Obs[0]) < tempestObsLen {
+			return
+		}
+		if !ok {
+			st = &tempestStation{}
+			l.stations[msg.SerialNumber] = st
+		}
+		o := msg.Obs[0]
+		r := func(i int) reading { return reading{value: o[i], valid: true} }
+		if day := now.Format("2006-01-02"); day != st.rainDay {
+			st.rainDay, st.rainToday = day, 0
+		}
+		st.rainToday += o[tempestRain]
+		st.obs = Observation{
+			StationID:      msg.SerialNumber,
+			ObservedAt:     time.Unix(int64(o[0]), 0),
+			Temperature:    r(tempestTemperature),
+			Humidity:       r(tempestHumidity),
+			WindDirection:  r(tempestWindDirection),
+			WindSpeed:      r(tempestWindAvg).convert(msToKph),
+			WindGust:       r(tempestWindGust).convert(msToKph),
+			PrecipToday:    reading{value: st.rainToday, valid: true},
+			Pressure:       r(tempestPressure),
+			UV:             r(tempestUV),
+			SolarRadiation: r(tempestSolarRadiation),
+		}
+		slog.Debug("Received Tempest observation", "station", msg.SerialNumber)
+	case "rapid_wind":
+		// Sent every few seconds, but only once there is an observation
+		// to add it to.
+		if !ok || len(msg.Ob) < 3 {
+			return
+		}
+		st.obs.WindSpeed = reading{value: msToKph(msg.Ob[1]), valid: true}
+		st.obs.WindDirection = reading{value: msg.Ob[2], valid: true}
+	case "evt_precip":
+		slog.Info("Tempest detected the start of rain", "station", msg.SerialNumber)
+		return
+	default:
+		return
+	}
+	l.uploads.put(st.obs)
+}
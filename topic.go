@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// topicData is the data available to -topic-template. Alias is the station's
+// alias, or its ID if it has none, and Labels are its configured labels.
+type topicData struct {
+	Prefix    string
+	StationID string
+	Alias     string
+	Labels    map[string]string
+	Property  string
+	Area      string
+}
+
+// topicTemplate builds the MQTT topic a station property is published to.
+type topicTemplate struct {
+	tmpl   *template.Template
+	prefix string
+	area   string
+
+	alias  string
+	labels map[string]string
+}
+
+func newTopicTemplate(text string, prefix string, area string) (*topicTemplate, error) {
+	// Missing labels are empty rather than "<no value>".
+	tmpl, err := template.New("topic").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &topicTemplate{tmpl: tmpl, prefix: strings.TrimSuffix(prefix, "/"), area: area}
+	// Catch references to unknown fields now rather than on every publish.
+	if err = tmpl.Execute(&bytes.Buffer{}, topicData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// forStation returns the template for a station with an alias, labels or its
+// own area.
+func (t *topicTemplate) forStation(alias string, labels map[string]string, area string) *topicTemplate {
+	return &topicTemplate{t.tmpl, t.prefix, area, alias, labels}
+}
+
+func (t *topicTemplate) topic(stationID string, property string) string {
+	alias := t.alias
+	if alias == "" {
+		alias = stationID
+	}
+	var b bytes.Buffer
+	// Can't fail, as the template was executed successfully when created.
+	t.tmpl.Execute(&b, topicData{t.prefix, stationID, alias, t.labels, property, t.area})
+	return b.String()
+}
+
+// refreshAllTopic returns the topic that triggers a fetch of every station.
+func (t *topicTemplate) refreshAllTopic() string {
+	return t.prefix + "/cmd/refresh_all"
+}
+
+// topicMatches reports whether topic matches the MQTT topic filter, which may
+// contain + and # wildcards.
+func topicMatches(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i == len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// statusTopic returns the topic carrying the bridge's own online status.
+func (t *topicTemplate) statusTopic(clientID string) string {
+	return t.prefix + "/" + clientID + "/status"
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// units describes how observations are published for a unit system: which
+// topic suffixes and gauges are used, and the unit symbols announced to
+// Home Assistant.
+type units struct {
+	name string
+
+	temperatureTopic string
+	feelsLikeTopic   string
+	dewPointTopic    string
+	windSpeedTopic   string
+	precipTopic      string
+	windGustTopic    string
+	precip1hrTopic   string
+	precipRateTopic  string
+	precip24hTopic   string
+	precipTodayTopic string
+	visibilityTopic  string
+	heatIndexTopic   string
+	windChillTopic   string
+
+	temperatureSymbol string
+	windSpeedSymbol   string
+	precipSymbol      string
+	precipRateSymbol  string
+	distanceSymbol    string
+
+	// shortTemperature is the temperature suffix of forecast properties.
+	shortTemperature string
+
+	// Observations are in metric units, and converted with these.
+	convertTemperature func(float64) float64
+	convertSpeed       func(float64) float64
+	convertPrecip      func(float64) float64
+	convertDistance    func(float64) float64
+
+	// Temperatures outside this range are considered implausible.
+	minTemperature float64
+	maxTemperature float64
+
+	temperature   *prometheus.GaugeVec
+	dewPoint      *prometheus.GaugeVec
+	windSpeed     *prometheus.GaugeVec
+	precipitation *prometheus.GaugeVec
+	windGust      *prometheus.GaugeVec
+	precip1hr     *prometheus.GaugeVec
+	precipRate    *prometheus.GaugeVec
+	precip24h     *prometheus.GaugeVec
+	visibility    *prometheus.GaugeVec
+	heatIndex     *prometheus.GaugeVec
+	windChill     *prometheus.GaugeVec
+}
+
+var metricUnits = units{
+	name:               "metric",
+	temperatureTopic:   "temperature_degrees",
+	feelsLikeTopic:     "temperature_feels_like_degrees",
+	dewPointTopic:      "dewpoint_degrees",
+	windSpeedTopic:     "wind_kph",
+	precipTopic:        "precip_today_mm",
+	windGustTopic:      "wind_gust_kph",
+	precip1hrTopic:     "precip_1hr_mm",
+	precipRateTopic:    "precip_rate_mm_per_hour",
+	precip24hTopic:     "precip_last_24h_mm",
+	precipTodayTopic:   "precip_since_midnight_mm",
+	visibilityTopic:    "visibility_km",
+	heatIndexTopic:     "heat_index_degrees",
+	windChillTopic:     "wind_chill_degrees",
+	temperatureSymbol:  "°C",
+	windSpeedSymbol:    "km/h",
+	precipSymbol:       "mm",
+	precipRateSymbol:   "mm/h",
+	distanceSymbol:     "km",
+	shortTemperature:   "c",
+	convertTemperature: identity,
+	convertSpeed:       identity,
+	convertPrecip:      identity,
+	convertDistance:    identity,
+	minTemperature:     -100,
+	maxTemperature:     70,
+	temperature:        temperature,
+	dewPoint:           dewPoint,
+	windSpeed:          windSpeed,
+	precipitation:      precipitation,
+	windGust:           windGust,
+	precip1hr:          precipitation1hr,
+	precipRate:         precipitationRate,
+	precip24h:          precipitation24h,
+	visibility:         visibility,
+	heatIndex:          heatIndex,
+	windChill:          windChill,
+}
+
+var imperialUnits = units{
+	name:               "imperial",
+	temperatureTopic:   "temperature_fahrenheit",
+	feelsLikeTopic:     "temperature_feels_like_fahrenheit",
+	dewPointTopic:      "dewpoint_fahrenheit",
+	windSpeedTopic:     "wind_mph",
+	precipTopic:        "precip_today_in",
+	windGustTopic:      "wind_gust_mph",
+	precip1hrTopic:     "precip_1hr_in",
+	precipRateTopic:    "precip_rate_in_per_hour",
+	precip24hTopic:     "precip_last_24h_in",
+	precipTodayTopic:   "precip_since_midnight_in",
+	visibilityTopic:    "visibility_mi",
+	heatIndexTopic:     "heat_index_fahrenheit",
+	windChillTopic:     "wind_chill_fahrenheit",
+	temperatureSymbol:  "°F",
+	windSpeedSymbol:    "mph",
+	precipSymbol:       "in",
+	precipRateSymbol:   "in/h",
+	distanceSymbol:     "mi",
+	shortTemperature:   "f",
+	convertTemperature: celsiusToFahrenheit,
+	convertSpeed:       kphToMph,
+	convertPrecip:      mmToInches,
+	convertDistance:    kmToMiles,
+	minTemperature:     -150,
+	maxTemperature:     160,
+	temperature:        temperatureFahrenheit,
+	dewPoint:           dewPointFahrenheit,
+	windSpeed:          windSpeedMph,
+	precipitation:      precipitationInches,
+	windGust:           windGustMph,
+	precip1hr:          precipitation1hrInches,
+	precipRate:         precipitationRateInches,
+	precip24h:          precipitation24hInches,
+	visibility:         visibilityMiles,
+	heatIndex:          heatIndexFahrenheit,
+	windChill:          windChillFahrenheit,
+}
+
+// unitNames returns the names of us, separated by commas.
+func unitNames(us []units) string {
+	var names []string
+	for _, u := range us {
+		names = append(names, u.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// parseUnits returns the unit systems to publish: metric, imperial, or both.
+func parseUnits(name string) ([]units, error) {
+	switch name {
+	case "metric":
+		return []units{metricUnits}, nil
+	case "imperial":
+		return []units{imperialUnits}, nil
+	case "both":
+		return []units{metricUnits, imperialUnits}, nil
+	}
+	return nil, fmt.Errorf("unknown units %q, expected metric, imperial or both", name)
+}
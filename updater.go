@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// updaterOptions holds the settings shared by all station updaters.
+type updaterOptions struct {
+	interval time.Duration
+	units    []units
+
+	// Observations are published to topics built by topics, and area is
+	// used as the area label of the gauges.
+	topics *topicTemplate
+	area   string
+
+	// alias replaces the station ID as the sensor_name label of the gauges,
+	// and labels are published with the station attributes.
+	alias  string
+	labels map[string]string
+
+	// spreadStart delays the first fetch by a random part of the interval,
+	// and every later fetch is moved by a random offset of up to ±jitter.
+	spreadStart bool
+	jitter      time.Duration
+
+	// publishProperties publishes each property to its own topic, and
+	// publishJSON publishes all of them as one retained JSON object to
+	// .../state.
+	publishProperties bool
+	publishJSON       bool
+
+	// qos and retain are used for every observation published, unless
+	// overridden for the property in properties.
+	qos        byte
+	retain     bool
+	properties map[string]propertyConfig
+
+	// haDiscovery publishes the station attributes referenced by the
+	// Home Assistant discovery configs.
+	haDiscovery bool
+
+	// Unchanged property values are only republished this often.
+	republishInterval time.Duration
+
+	// The station's availability topic reads "stale" after staleAfter
+	// consecutive failed fetches, and "online" again after a success.
+	staleAfter int
+
+	// Observations taken longer than maxObservationAge ago, such as cached
+	// ones served for a station that stopped reporting, aren't published
+	// and mark the station stale. Zero accepts observations of any age.
+	maxObservationAge time.Duration
+
+	// observed records every observation fetched, for virtual stations
+	// aggregating this one.
+	observed *uploadStore
+
+	// clock schedules the fetches and tells the time of publishes, or is
+	// the system clock if nil.
+	clock clock
+
+	// Once a station hasn't been fetched for staleTTL, its retained topics
+	// are cleared and its gauges deleted. Zero keeps them forever.
+	staleTTL time.Duration
+
+	// Forecasts are fetched this often from providers that support them,
+	// or never if zero.
+	forecastInterval time.Duration
+
+	// Weather alerts are fetched this often from providers that support
+	// them, or never if zero.
+	alertsInterval time.Duration
+
+	// astronomy publishes the sunrise, sunset and moon phase of stations
+	// whose position is configured or reported.
+	astronomy bool
+
+	// location is the configured position of the station, if any. The
+	// position reported in its observations replaces it.
+	location *geoArea
+
+	// dailySummary publishes the statistics of each station's day, which
+	// starts at midnight in timezone, or the local timezone if nil.
+	dailySummary bool
+	timezone     *time.Location
+
+	// messageExpiry is the MQTT 5 message expiry interval of retained
+	// observations.
+	messageExpiry time.Duration
+
+	// cache, if set, persists the last observation of each station.
+	cache *observationCache
+
+	// Observations are also written to every sink.
+	sinks []Sink
+
+	// Failed fetches are retried up to retries times, starting after
+	// retryDelay and doubling up to retryMaxDelay between attempts. Client
+	// errors such as a rejected API key aren't retried.
+	retries       int
+	retryDelay    time.Duration
+	retryMaxDelay time.Duration
+}
+
+// setPayloadMode selects how observations are published: "split" publishes
+// each property to its own topic, "json" publishes them all to .../state, and
+// "both" does both.
+func (o *updaterOptions) setPayloadMode(mode string) error {
+	switch mode {
+	case "split":
+		o.publishProperties, o.publishJSON = true, false
+	case "json":
+		o.publishProperties, o.publishJSON = false, true
+	case "both":
+		o.publishProperties, o.publishJSON = true, true
+	default:
+		return fmt.Errorf("unknown payload mode %q, expected split, json or both", mode)
+	}
+	return nil
+}
+
+// publishFlags returns the QoS and retain flag to publish property with,
+// which are qos and retain unless overridden in the config.
+func (o *updaterOptions) publishFlags(property string, qos byte, retain bool) (byte, bool) {
+	if p, ok := o.properties[property]; ok {
+		if p.QoS != nil {
+			qos = byte(*p.QoS)
+		}
+		if p.Retain != nil {
+			retain = *p.Retain
+		}
+	}
+	return qos, retain
+}
+
+// enabled reports whether property is published at all.
+func (o *updaterOptions) enabled(property string) bool {
+	return !o.properties[property].Disabled
+}
+
+// publishedName returns the name property is published under, in topics and
+// everywhere else.
+func (o *updaterOptions) publishedName(property string) string {
+	if name := o.properties[property].Name; name != "" {
+		return name
+	}
+	return property
+}
+
+// sensors returns the sensors announced to Home Assistant, leaving out the
+// disabled properties and naming the rest as they are published.
+func (o *updaterOptions) sensors() []sensor {
+	var list []sensor
+	for _, s := range sensors(o.units) {
+		if o.enabled(s.property) {
+			s.property = o.publishedName(s.property)
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// deadbands returns the configured deadband of each property that has one.
+func (o *updaterOptions) deadbands() map[string]float64 {
+	deadbands := map[string]float64{}
+	for property, p := range o.properties {
+		if p.Deadband > 0 {
+			deadbands[property] = p.Deadband
+		}
+	}
+	return deadbands
+}
+
+// timeLocation returns the timezone whose midnight starts the station's day.
+func (o *updaterOptions) timeLocation() *time.Location {
+	if o.timezone != nil {
+		return o.timezone
+	}
+	return time.Local
+}
+
+// timeSource returns the clock of the updater, or the system clock if none
+// is set.
+func (o *updaterOptions) timeSource() clock {
+	if o.clock == nil {
+		return systemClock{}
+	}
+	return o.clock
+}
+
+// sensorName returns the sensor_name label of the station's gauges.
+func (o *updaterOptions) sensorName(stationID string) string {
+	if o.alias != "" {
+		return o.alias
+	}
+	return stationID
+}
+
+// updater polls a station until ctx is cancelled. A value on refresh fetches
+// it right away, unless it was just fetched.
+func updater(ctx context.Context, stationID string, provider Provider, opts updaterOptions, pub Publisher, h *health, refresh <-chan struct{}) {
+	logger := slog.With("station", stationID, "provider", provider.Name())
+	clk := opts.timeSource()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if f, ok := provider.(forecaster); ok && opts.forecastInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forecastUpdater(ctx, logger, stationID, f, opts, pub)
+		}()
+	}
+	if a, ok := provider.(alerter); ok && opts.alertsInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alertUpdater(ctx, logger, stationID, a, opts, pub)
+		}()
+	}
+	var loc *stationLocation
+	if opts.astronomy {
+		loc = newStationLocation()
+		if opts.location != nil {
+			loc.set(opts.location.lat, opts.location.lon)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			astronomyUpdater(ctx, logger, stationID, loc, opts, pub)
+		}()
+	}
+	located := func(obs Observation) {
+		if loc != nil && obs.Latitude.valid && obs.Longitude.valid {
+			loc.set(obs.Latitude.value, obs.Longitude.value)
+		}
+	}
+	var summary *summaryTracker
+	if opts.dailySummary {
+		summary = newSummaryTracker(opts.timeLocation())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summaryUpdater(ctx, logger, stationID, summary, clk, opts, pub)
+		}()
+	}
+	obsPub := newObservationPublisher(logger, stationID, opts)
+	rain := rainTracker{location: opts.timeLocation()}
+	var failures int
+	var lastFetched, lastAttempt time.Time
+	var availability string
+	setAvailability := func(state string) {
+		if state != availability {
+			availability = state
+			qos, retain := opts.publishFlags("availability", 1, true)
+			pub.Publish(opts.topics.topic(stationID, "availability"), qos, retain, state)
+		}
+	}
+	fetchAndCount := func(ctx context.Context) (Observation, error) {
+		started := clk.now()
+		lastAttempt = started
+		h.attempted(stationID)
+		ctx, span := tracer.Start(ctx, "fetch")
+		data, err := provider.Observe(ctx, stationID)
+		endSpan(span, err)
+		fetchDuration.WithLabelValues(stationID).Observe(clk.now().Sub(started).Seconds())
+		if err != nil {
+			fetchTotal.WithLabelValues(stationID, "error").Inc()
+			legacyFetchTotal.WithLabelValues(stationID, "error").Inc()
+		} else {
+			fetchTotal.WithLabelValues(stationID, "success").Inc()
+			legacyFetchTotal.WithLabelValues(stationID, "success").Inc()
+			// The rest of the observation is still published.
+			for field, value := range data.malformedFields() {
+				logger.Warn("Ignoring unparsable value", "field", field, "value", value)
+				parseErrors.WithLabelValues(stationID, field).Inc()
+			}
+			lastFetched = clk.now()
+			lastSuccess.WithLabelValues(stationID).Set(float64(lastFetched.Unix()))
+			legacyLastSuccess.WithLabelValues(stationID).Set(float64(lastFetched.Unix()))
+			h.fetched(stationID)
+		}
+		return data, err
+	}
+	// wait sleeps for d or until a refresh is requested, returning false if
+	// ctx is cancelled first. Refreshes are limited like the interval, to
+	// protect the API quota.
+	wait := func(d time.Duration) bool {
+		t, stop := clk.timer(d)
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-t:
+				return true
+			case <-refresh:
+				if min := minProviderInterval(provider); clk.now().Sub(lastAttempt) < min {
+					logger.Info("Ignoring refresh, fetched too recently", "last_fetch", lastAttempt, "min", min)
+					continue
+				}
+				logger.Info("Refreshing")
+				return true
+			}
+		}
+	}
+	// Republish the cached observation right away, which also primes the
+	// filter so that values unchanged since then aren't published again.
+	if opts.cache != nil {
+		if c, ok := opts.cache.get(stationID); ok && (opts.staleTTL == 0 || clk.now().Sub(c.FetchedAt) < opts.staleTTL) {
+			logger.Info("Restoring cached observation", "fetched_at", c.FetchedAt)
+			restored := *obsPub
+			restored.opts.sinks = nil
+			restored.publish(ctx, pub, c.Observation, c.FetchedAt)
+			lastFetched = c.FetchedAt
+			located(c.Observation)
+		}
+	}
+	// Fetches are scheduled every interval from start, each shifted by up to
+	// ±jitter so that stations don't stay synchronized.
+	start := clk.now()
+	if opts.spreadStart {
+		start = start.Add(time.Duration(rand.Int63n(int64(opts.interval))))
+		logger.Debug("Delaying first fetch", "until", start)
+		if !wait(start.Sub(clk.now())) {
+			return
+		}
+	}
+	next := start
+	for {
+		logger.Debug("Fetching latest observation")
+		// Each update is traced from the fetch to the publishes.
+		updateCtx, span := tracer.Start(ctx, "update", trace.WithAttributes(
+			attribute.String("station", stationID),
+			attribute.String("provider", provider.Name()),
+		))
+		obs, err := fetchAndCount(updateCtx)
+		delay := opts.retryDelay
+		for attempt := 1; err != nil && retryable(err) && attempt <= opts.retries; attempt++ {
+			logger.Warn("Fetch failed, retrying", "err", err, "delay", delay, "attempt", attempt, "retries", opts.retries)
+			if !sleepOn(ctx, clk, delay) {
+				span.End()
+				return
+			}
+			obs, err = fetchAndCount(updateCtx)
+			if delay *= 2; delay > opts.retryMaxDelay {
+				delay = opts.retryMaxDelay
+			}
+		}
+
+		if ctx.Err() != nil {
+			span.End()
+			return
+		} else if err != nil {
+			logger.Error("Fetch failed", "err", err)
+			if failures++; failures >= opts.staleAfter {
+				setAvailability("stale")
+			}
+			if opts.staleTTL > 0 && !lastFetched.IsZero() && clk.now().Sub(lastFetched) > opts.staleTTL {
+				logger.Warn("Station expired, clearing its values", "last_fetched", lastFetched)
+				expire(pub, obsPub.filter, stationID, opts)
+				lastFetched = time.Time{}
+			}
+		} else if age := clk.now().Sub(obs.ObservedAt); opts.maxObservationAge > 0 && !obs.ObservedAt.IsZero() && age > opts.maxObservationAge {
+			logger.Warn("Observation is too old, the station may have stopped reporting", "observed_at", obs.ObservedAt, "age", age.Round(time.Second))
+			staleObservations.WithLabelValues(stationID).Inc()
+			setAvailability("stale")
+		} else {
+			failures = 0
+			if opts.observed != nil {
+				// Recorded before deriving, so that virtual stations
+				// derive from their aggregated readings.
+				member := obs
+				member.StationID = stationID
+				opts.observed.put(member)
+			}
+			deriveMissing(&obs)
+			fetchedAt := clk.now()
+			rain.update(&obs, fetchedAt)
+			user := []userProperty{
+				{"provider", provider.Name()},
+				{"units", unitNames(opts.units)},
+				{"fetched_at", fetchedAt.UTC().Format(time.RFC3339)},
+			}
+			if !obs.ObservedAt.IsZero() {
+				user = append(user, userProperty{"observed_at", obs.ObservedAt.UTC().Format(time.RFC3339)})
+			}
+			obsPub.publish(ctx, withProperties(pub, messageProperties{expiry: opts.messageExpiry, user: user, trace: span.SpanContext()}), obs, fetchedAt)
+			located(obs)
+			if summary != nil {
+				if today, yesterday, ended := summary.add(obs, fetchedAt); ended {
+					publishSummary(logger, pub, stationID, today, &yesterday, opts)
+				} else {
+					publishSummary(logger, pub, stationID, today, nil, opts)
+				}
+			}
+			if opts.cache != nil {
+				if err := opts.cache.put(stationID, obs, fetchedAt); err != nil {
+					logger.Warn("Failed to write observation cache", "err", err)
+				}
+			}
+			setAvailability("online")
+		}
+		endSpan(span, err)
+
+		// Skip any slots missed while retrying, as a ticker would.
+		for now := clk.now(); !next.After(now); {
+			next = next.Add(opts.interval)
+		}
+		var offset time.Duration
+		if opts.jitter > 0 {
+			offset = time.Duration(rand.Int63n(int64(2*opts.jitter))) - opts.jitter
+		}
+		if !wait(next.Add(offset).Sub(clk.now())) {
+			return
+		}
+	}
+}
+
+// expire clears the retained topics published for a station, and deletes its
+// gauges, so that consumers don't mistake old values for current ones.
+func expire(pub Publisher, filter *changeFilter, stationID string, opts updaterOptions) {
+	topics := map[string]string{}
+	for _, property := range filter.forget() {
+		topics[property] = opts.publishedName(property)
+	}
+	if opts.haDiscovery {
+		topics["attributes"] = "attributes"
+	}
+	if opts.publishJSON {
+		topics["state"] = "state"
+	}
+	for property, name := range topics {
+		qos, _ := opts.publishFlags(property, opts.qos, true)
+		pub.Publish(opts.topics.topic(stationID, name), qos, true, "")
+	}
+	for _, g := range weatherGauges {
+		g.DeleteLabelValues(opts.sensorName(stationID), opts.area)
+	}
+	heartbeat.DeleteLabelValues(stationID)
+}
+
+// observationPublisher publishes the observations of a station to MQTT, the
+// gauges and the sinks, keeping the filter and validator state that spans
+// observations.
+type observationPublisher struct {
+	logger    *slog.Logger
+	stationID string
+	opts      updaterOptions
+	filter    *changeFilter
+	valid     *validator
+	// gauges is false to leave the gauges alone, as when writing past
+	// observations.
+	gauges bool
+}
+
+func newObservationPublisher(logger *slog.Logger, stationID string, opts updaterOptions) *observationPublisher {
+	return &observationPublisher{
+		logger:    logger,
+		stationID: stationID,
+		opts:      opts,
+		filter:    newChangeFilter(opts.republishInterval, opts.deadbands(), opts.timeSource()),
+		valid:     newValidator(opts.properties),
+		gauges:    true,
+	}
+}
+
+// publish publishes an observation fetched at the given time to pub, and
+// updates the gauges and sinks.
+// Properties whose value hasn't changed are left to the filter, and missing
+// readings and those rejected by the validator are skipped so the last good
+// retained value remains.
+func (p *observationPublisher) publish(ctx context.Context, pub Publisher, obs Observation, at time.Time) {
+	logger, stationID, opts, filter, valid := p.logger, p.stationID, p.opts, p.filter, p.valid
+	state := map[string]interface{}{}
+	values := map[string]float64{}
+	set := func(property string, value interface{}) {
+		if !opts.enabled(property) {
+			return
+		}
+		state[opts.publishedName(property)] = value
+		if opts.publishProperties && filter.shouldPublish(property, value) {
+			qos, retain := opts.publishFlags(property, opts.qos, opts.retain)
+			pub.Publish(opts.topics.topic(stationID, opts.publishedName(property)), qos, retain, fmt.Sprint(value))
+		}
+	}
+	measure := func(property string, r reading, min float64, max float64, gauge *prometheus.GaugeVec) (float64, bool) {
+		if !opts.enabled(property) {
+			return 0, false
+		}
+		if !r.valid {
+			logger.Debug("Skipping missing reading", "property", property)
+			return 0, false
+		}
+		value := r.value
+		if reason := valid.check(property, value, min, max, at); reason != "" {
+			logger.Warn("Rejecting implausible reading", "property", property, "value", value, "reason", reason)
+			rejectedValues.WithLabelValues(stationID, property, reason).Inc()
+			return 0, false
+		}
+		set(property, value)
+		values[opts.publishedName(property)] = value
+		if gauge != nil && p.gauges {
+			gauge.WithLabelValues(opts.sensorName(stationID), opts.area).Set(value)
+		}
+		return value, true
+	}
+
+	attributes := stationAttributes{StationID: stationID, Alias: opts.alias, Labels: opts.labels}
+	if value, ok := measure("latitude", obs.Latitude, -90, 90, nil); ok {
+		attributes.Latitude = &value
+	}
+	if value, ok := measure("longitude", obs.Longitude, -180, 180, nil); ok {
+		attributes.Longitude = &value
+	}
+
+	for _, u := range opts.units {
+		if value, ok := measure(u.temperatureTopic, obs.Temperature.convert(u.convertTemperature), u.minTemperature, u.maxTemperature, u.temperature); ok {
+			logger.Debug("Fetched observation", "temperature", value, "unit", u.temperatureSymbol)
+		}
+		measure(u.feelsLikeTopic, obs.FeelsLike.convert(u.convertTemperature), u.minTemperature, u.maxTemperature, nil)
+		measure(u.dewPointTopic, obs.DewPoint.convert(u.convertTemperature), u.minTemperature, u.maxTemperature, u.dewPoint)
+		measure(u.windSpeedTopic, obs.WindSpeed.convert(u.convertSpeed), 0, math.MaxFloat64, u.windSpeed)
+		measure(u.precipTopic, obs.PrecipToday.convert(u.convertPrecip), 0, math.MaxFloat64, u.precipitation)
+		measure(u.windGustTopic, obs.WindGust.convert(u.convertSpeed), 0, math.MaxFloat64, u.windGust)
+		measure(u.precip1hrTopic, obs.Precip1hr.convert(u.convertPrecip), 0, math.MaxFloat64, u.precip1hr)
+		measure(u.precipRateTopic, obs.PrecipRate.convert(u.convertPrecip), 0, math.MaxFloat64, u.precipRate)
+		measure(u.precip24hTopic, obs.PrecipLast24h.convert(u.convertPrecip), 0, math.MaxFloat64, u.precip24h)
+		measure(u.precipTodayTopic, obs.PrecipSinceMidnight.convert(u.convertPrecip), 0, math.MaxFloat64, nil)
+		measure(u.visibilityTopic, obs.Visibility.convert(u.convertDistance), 0, math.MaxFloat64, u.visibility)
+		measure(u.heatIndexTopic, obs.HeatIndex.convert(u.convertTemperature), u.minTemperature, u.maxTemperature, u.heatIndex)
+		measure(u.windChillTopic, obs.WindChill.convert(u.convertTemperature), u.minTemperature, u.maxTemperature, u.windChill)
+	}
+	measure("relative_humidity_percent", obs.Humidity, 0, 100, humidity)
+	measure("absolute_humidity_gm3", obs.AbsoluteHumidity, 0, 100, absoluteHumidity)
+	measure("pressure_mb", obs.Pressure, 800, 1100, pressure)
+	measure("wind_degrees", obs.WindDirection, 0, 360, windDirection)
+	measure("uv_index", obs.UV, 0, 20, uvIndex)
+	measure("solar_radiation_wm2", obs.SolarRadiation, 0, 2000, solarRadiation)
+	set("last_update", at.UTC().Format(time.RFC3339))
+	if !obs.ObservedAt.IsZero() {
+		set("observation_timestamp", obs.ObservedAt.UTC().Format(time.RFC3339))
+	}
+	if p.gauges {
+		heartbeat.WithLabelValues(stationID).Set(float64(at.Unix()))
+	}
+
+	if opts.haDiscovery {
+		if payload, err := json.Marshal(attributes); err != nil {
+			logger.Error("Failed to encode attributes", "err", err)
+		} else {
+			qos, retain := opts.publishFlags("attributes", opts.qos, true)
+			pub.Publish(opts.topics.topic(stationID, "attributes"), qos, retain, payload)
+		}
+	}
+
+	if opts.publishJSON {
+		if payload, err := json.Marshal(state); err != nil {
+			logger.Error("Failed to encode state", "err", err)
+		} else {
+			qos, retain := opts.publishFlags("state", opts.qos, true)
+			pub.Publish(opts.topics.topic(stationID, "state"), qos, retain, payload)
+		}
+	}
+
+	// Sinks are written last, so that MQTT isn't held up by them, and have
+	// until the next fetch to finish.
+	if opts.interval > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.interval)
+		defer cancel()
+	}
+	writeSinks(ctx, logger, opts.sinks, stationID, at, values)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher records the last payload published to each topic.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	payloads map[string]string
+	retained map[string]bool
+	count    int
+}
+
+func newRecordingPublisher() *recordingPublisher {
+	return &recordingPublisher{payloads: map[string]string{}, retained: map[string]bool{}}
+}
+
+func (p *recordingPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := payload.([]byte); ok {
+		payload = string(b)
+	}
+	p.payloads[topic] = fmt.Sprint(payload)
+	p.retained[topic] = retained
+	p.count++
+}
+
+func (p *recordingPublisher) published() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	published := map[string]string{}
+	for topic, payload := range p.payloads {
+		published[topic] = payload
+	}
+	return published
+}
+
+// reset forgets what was published, for checking what is published next.
+func (p *recordingPublisher) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payloads, p.retained, p.count = map[string]string{}, map[string]bool{}, 0
+}
+
+func testOptions(t *testing.T) updaterOptions {
+	t.Helper()
+	topics, err := newTopicTemplate("{{.Prefix}}/{{.StationID}}/{{.Property}}", "wgd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updaterOptions{
+		interval:          10 * time.Minute,
+		units:             []units{metricUnits},
+		topics:            topics,
+		publishProperties: true,
+		retain:            true,
+		staleAfter:        3,
+		properties:        map[string]propertyConfig{},
+	}
+}
+
+var testObservation = Observation{
+	StationID:     "KX1",
+	ObservedAt:    time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC),
+	Temperature:   valid(21.5),
+	Humidity:      valid(40),
+	WindDirection: valid(180),
+	Pressure:      reading{malformed: "1013 mb"},
+	WindSpeed:     valid(-9999),
+}
+
+func TestPublishObservation(t *testing.T) {
+	at := time.Date(2026, 10, 14, 12, 1, 0, 0, time.UTC)
+	disabled, renamed := propertyConfig{Disabled: true}, propertyConfig{Name: "temp_c"}
+	tests := []struct {
+		name       string
+		configure  func(*updaterOptions)
+		want       map[string]string
+		wantAbsent []string
+	}{
+		{
+			name: "split",
+			want: map[string]string{
+				"wgd/KX1/temperature_degrees":       "21.5",
+				"wgd/KX1/relative_humidity_percent": "40",
+				"wgd/KX1/wind_degrees":              "180",
+				"wgd/KX1/last_update":               "2026-10-14T12:01:00Z",
+				"wgd/KX1/observation_timestamp":     "2026-10-14T12:00:00Z",
+			},
+			// Missing and unparsable readings are left out, as is the
+			// implausible wind speed.
+			wantAbsent: []string{"wgd/KX1/pressure_mb", "wgd/KX1/wind_kph", "wgd/KX1/state"},
+		},
+		{
+			name:      "json",
+			configure: func(o *updaterOptions) { o.setPayloadMode("json") },
+			want: map[string]string{
+				"wgd/KX1/state": `{"last_update":"2026-10-14T12:01:00Z","observation_timestamp":"2026-10-14T12:00:00Z","relative_humidity_percent":40,"temperature_degrees":21.5,"wind_degrees":180}`,
+			},
+			wantAbsent: []string{"wgd/KX1/temperature_degrees"},
+		},
+		{
+			name: "disabled and renamed",
+			configure: func(o *updaterOptions) {
+				o.properties = map[string]propertyConfig{"wind_degrees": disabled, "temperature_degrees": renamed}
+			},
+			want:       map[string]string{"wgd/KX1/temp_c": "21.5"},
+			wantAbsent: []string{"wgd/KX1/temperature_degrees", "wgd/KX1/wind_degrees"},
+		},
+		{
+			name: "out of the configured range",
+			configure: func(o *updaterOptions) {
+				max := 20.0
+				o.properties = map[string]propertyConfig{"temperature_degrees": {Max: &max}}
+			},
+			want:       map[string]string{"wgd/KX1/relative_humidity_percent": "40"},
+			wantAbsent: []string{"wgd/KX1/temperature_degrees"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions(t)
+			if tt.configure != nil {
+				tt.configure(&opts)
+			}
+			pub := newRecordingPublisher()
+			newObservationPublisher(slog.Default(), "KX1", opts).publish(context.Background(), pub, testObservation, at)
+			published := pub.published()
+			for topic, want := range tt.want {
+				if got, ok := published[topic]; !ok {
+					t.Errorf("%s not published", topic)
+				} else if got != want {
+					t.Errorf("%s = %s, want %s", topic, got, want)
+				}
+			}
+			for _, topic := range tt.wantAbsent {
+				if got, ok := published[topic]; ok {
+					t.Errorf("%s published as %s", topic, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatorRejectsNonFinite(t *testing.T) {
+	v := newValidator(nil)
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if reason := v.check("temperature_degrees", value, math.Inf(-1), math.Inf(1), time.Time{}); reason != "range" {
+			t.Errorf("%v rejected for %q, want range", value, reason)
+		}
+	}
+	if _, ok := v.last["temperature_degrees"]; ok {
+		t.Error("non-finite value accepted as the last reading")
+	}
+}
+
+func TestPublishObservationFiltersUnchanged(t *testing.T) {
+	opts := testOptions(t)
+	opts.republishInterval = time.Hour
+	opts.properties = map[string]propertyConfig{"temperature_degrees": {Deadband: 0.5}}
+	pub := newRecordingPublisher()
+	p := newObservationPublisher(slog.Default(), "KX1", opts)
+	at := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	p.publish(context.Background(), pub, testObservation, at)
+
+	pub.reset()
+	next := testObservation
+	next.Temperature = valid(21.7)
+	next.Humidity = valid(42)
+	p.publish(context.Background(), pub, next, at.Add(10*time.Minute))
+	published := pub.published()
+	if _, ok := published["wgd/KX1/temperature_degrees"]; ok {
+		t.Error("temperature within the deadband was republished")
+	}
+	if _, ok := published["wgd/KX1/wind_degrees"]; ok {
+		t.Error("unchanged wind direction was republished")
+	}
+	if got := published["wgd/KX1/relative_humidity_percent"]; got != "42" {
+		t.Errorf("humidity = %q, want 42", got)
+	}
+}
+
+func TestPublishObservationState(t *testing.T) {
+	opts := testOptions(t)
+	opts.setPayloadMode("both")
+	pub := newRecordingPublisher()
+	newObservationPublisher(slog.Default(), "KX1", opts).publish(context.Background(), pub, testObservation, testObservation.ObservedAt)
+	var state map[string]interface{}
+	if err := json.Unmarshal([]byte(pub.published()["wgd/KX1/state"]), &state); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"temperature_degrees":       21.5,
+		"relative_humidity_percent": 40.0,
+		"wind_degrees":              180.0,
+		"last_update":               "2026-10-14T12:00:00Z",
+		"observation_timestamp":     "2026-10-14T12:00:00Z",
+	}
+	if !reflect.DeepEqual(state, want) {
+		t.Errorf("state = %v, want %v", state, want)
+	}
+	if !pub.retained["wgd/KX1/state"] {
+		t.Error("state wasn't retained")
+	}
+}
+
+func TestUpdater(t *testing.T) {
+	// The responses to successive fetches.
+	statuses := []int{200, 500, 200, 404, 200}
+	var mu sync.Mutex
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		status := statuses[requests%len(statuses)]
+		requests++
+		mu.Unlock()
+		w.WriteHeader(status)
+		if status == 200 {
+			io.Copy(w, openFixture(t, "wunderground_conditions.json"))
+		}
+	}))
+	defer srv.Close()
+	fetched := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+	provider, err := newProvider("wunderground", providerOptions{apiKey: "key", baseURL: srv.URL, httpTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	clk := newFakeClock(start)
+	opts := testOptions(t)
+	opts.clock = clk
+	opts.republishInterval = 30 * time.Minute
+	opts.retries = 1
+	opts.retryDelay = time.Minute
+	opts.retryMaxDelay = time.Minute
+	opts.staleAfter = 1
+	h := newHealth(nil, opts.interval)
+	h.clock = clk
+	pub := newRecordingPublisher()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		updater(ctx, "KCASANFR58", provider, opts, pub, h, nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	steps := []struct {
+		name       string
+		advance    time.Duration
+		fetches    int
+		want       map[string]string
+		wantAbsent []string
+	}{
+		{
+			name:    "first fetch",
+			fetches: 1,
+			want: map[string]string{
+				"wgd/KCASANFR58/temperature_degrees": "18.3",
+				"wgd/KCASANFR58/last_update":         "2026-10-14T12:00:00Z",
+				"wgd/KCASANFR58/availability":        "online",
+			},
+		},
+		{
+			// Waiting for the retry.
+			name:       "server error",
+			advance:    10 * time.Minute,
+			fetches:    2,
+			wantAbsent: []string{"wgd/KCASANFR58/last_update", "wgd/KCASANFR58/availability"},
+		},
+		{
+			name:    "retried",
+			advance: time.Minute,
+			fetches: 3,
+			want:    map[string]string{"wgd/KCASANFR58/last_update": "2026-10-14T12:11:00Z"},
+			// Unchanged within the heartbeat.
+			wantAbsent: []string{"wgd/KCASANFR58/temperature_degrees", "wgd/KCASANFR58/availability"},
+		},
+		{
+			// Not retried, and waiting for the next interval.
+			name:       "unknown station",
+			advance:    9 * time.Minute,
+			fetches:    4,
+			want:       map[string]string{"wgd/KCASANFR58/availability": "stale"},
+			wantAbsent: []string{"wgd/KCASANFR58/last_update"},
+		},
+		{
+			name:    "heartbeat",
+			advance: 10 * time.Minute,
+			fetches: 5,
+			want: map[string]string{
+				"wgd/KCASANFR58/temperature_degrees": "18.3",
+				"wgd/KCASANFR58/last_update":         "2026-10-14T12:30:00Z",
+				"wgd/KCASANFR58/availability":        "online",
+			},
+		},
+	}
+	for _, s := range steps {
+		pub.reset()
+		clk.advance(s.advance)
+		clk.waitForTimers(t, 1)
+		if got := fetched(); got != s.fetches {
+			t.Fatalf("%s: fetched %d times, want %d", s.name, got, s.fetches)
+		}
+		published := pub.published()
+		for topic, want := range s.want {
+			if got, ok := published[topic]; !ok {
+				t.Errorf("%s: %s not published", s.name, topic)
+			} else if got != want {
+				t.Errorf("%s: %s = %s, want %s", s.name, topic, got, want)
+			}
+		}
+		for _, topic := range s.wantAbsent {
+			if got, ok := published[topic]; ok {
+				t.Errorf("%s: %s published as %s", s.name, topic, got)
+			}
+		}
+	}
+	if got := h.status("").Stations["KCASANFR58"].LastSuccess; got == nil || !got.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("last success = %v, want the last fetch", got)
+	}
+}
+
+func TestUpdaterConfiguredLocation(t *testing.T) {
+	clk := newFakeClock(time.Date(2026, 6, 21, 10, 0, 0, 0, time.UTC))
+	opts := testOptions(t)
+	opts.clock = clk
+	opts.astronomy = true
+	opts.location = &geoArea{lat: 59.3293, lon: 18.0686}
+	pub := newRecordingPublisher()
+	// No upload is received, so only the configured location positions
+	// the station.
+	provider := &pws{newUploadStore()}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		updater(ctx, "KX1", provider, opts, pub, newHealth(nil, opts.interval), nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The next fetch and the next change of the sun.
+	clk.waitForTimers(t, 2)
+	if got := pub.published()["wgd/KX1/sun_above_horizon"]; got != "true" {
+		t.Errorf("sun_above_horizon = %q, want true", got)
+	}
+}
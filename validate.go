@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rejectedValues = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "wgd2mqtt_rejected_values_total",
+		Help: "Number of readings rejected as implausible, by reason",
+	},
+	[]string{"station", "property", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(rejectedValues)
+}
+
+// validator rejects implausible readings of a station: those outside the
+// plausible range of their property, and those that changed faster than its
+// max_change_per_hour since the last accepted reading.
+type validator struct {
+	properties map[string]propertyConfig
+	last       map[string]publishedValue
+}
+
+func newValidator(properties map[string]propertyConfig) *validator {
+	return &validator{properties: properties, last: map[string]publishedValue{}}
+}
+
+// check returns why value, read at the given time, was rejected for
+// property, or "" if it was accepted. min and max are the default plausible
+// range, which the config may override. NaN and infinities are always out
+// of range, as NaN would otherwise pass the comparisons.
+func (v *validator) check(property string, value float64, min float64, max float64, at time.Time) string {
+	p := v.properties[property]
+	if p.Min != nil {
+		min = *p.Min
+	}
+	if p.Max != nil {
+		max = *p.Max
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) || value < min || value > max {
+		return "range"
+	}
+	if prev, ok := v.last[property]; ok && p.MaxChangePerHour > 0 {
+		// The allowed change grows with the time since the last accepted
+		// reading, so that a real change is accepted eventually.
+		hours := at.Sub(prev.at).Hours()
+		if hours > 0 && math.Abs(value-prev.value.(float64)) > p.MaxChangePerHour*hours {
+			return "rate"
+		}
+	}
+	v.last[property] = publishedValue{value, at}
+	return ""
+}
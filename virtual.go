@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ways a virtual station aggregates the readings of its members.
+const (
+	aggregateMean   = "mean"
+	aggregateMedian = "median"
+	aggregateMin    = "min"
+	aggregateMax    = "max"
+)
+
+func parseAggregate(aggregate string) (string, error) {
+	switch aggregate {
+	case "":
+		return aggregateMean, nil
+	case aggregateMean, aggregateMedian, aggregateMin, aggregateMax:
+		return aggregate, nil
+	}
+	return "", fmt.Errorf("unknown aggregate %q, expected mean, median, min or max", aggregate)
+}
+
+// observationField returns the index of the reading of Observation named
+// name, in snake case as in the config file, such as wind_speed.
+func observationField(name string) (int, bool) {
+	t := reflect.TypeOf(Observation{})
+	key := strings.ReplaceAll(name, "_", "")
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type == reflect.TypeOf(reading{}) && strings.EqualFold(t.Field(i).Name, key) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// virtualProvider reports the consensus of the latest observations of other
+// stations, as recorded by their updaters, for neighbourhoods where a single
+// station can't be relied on. Members that haven't been fetched within maxAge
+// are left out.
+type virtualProvider struct {
+	observed  *uploadStore
+	members   []string
+	aggregate string
+	// aggregates overrides aggregate for some readings, by field index.
+	aggregates map[int]string
+	maxAge     time.Duration
+}
+
+func newVirtualProvider(observed *uploadStore, c stationConfig) (*virtualProvider, error) {
+	if len(c.Members) == 0 {
+		return nil, fmt.Errorf("a virtual station needs members")
+	}
+	p := &virtualProvider{observed: observed, members: c.Members, aggregates: map[int]string{}, maxAge: c.MaxAge}
+	var err error
+	if p.aggregate, err = parseAggregate(c.Aggregate); err != nil {
+		return nil, err
+	}
+	for name, aggregate := range c.Aggregates {
+		i, ok := observationField(name)
+		if !ok {
+			return nil, fmt.Errorf("aggregates: unknown reading %q", name)
+		}
+		if p.aggregates[i], err = parseAggregate(aggregate); err != nil {
+			return nil, fmt.Errorf("aggregates: %s: %v", name, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *virtualProvider) Name() string { return "virtual" }
+
+func (p *virtualProvider) Observe(ctx context.Context, stationID string) (Observation, error) {
+	var members []Observation
+	now := p.observed.clock.now()
+	for _, id := range p.members {
+		u, ok := p.observed.get(id)
+		if !ok || now.Sub(u.at) > p.maxAge {
+			continue
+		}
+		if !u.obs.ObservedAt.IsZero() && now.Sub(u.obs.ObservedAt) > p.maxAge {
+			continue
+		}
+		members = append(members, u.obs)
+	}
+	if len(members) == 0 {
+		return Observation{}, fmt.Errorf("no recent observation from any of %s", strings.Join(p.members, ", "))
+	}
+
+	obs := Observation{StationID: stationID}
+	for _, m := range members {
+		if m.ObservedAt.After(obs.ObservedAt) {
+			obs.ObservedAt = m.ObservedAt
+		}
+	}
+	v := reflect.ValueOf(&obs).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if _, ok := v.Field(i).Interface().(reading); !ok {
+			continue
+		}
+		var values []float64
+		for _, m := range members {
+			if r := reflect.ValueOf(m).Field(i).Interface().(reading); r.valid {
+				values = append(values, r.value)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		aggregate, ok := p.aggregates[i]
+		if !ok {
+			aggregate = p.aggregate
+		}
+		value := aggregateValues(aggregate, values)
+		if i == windDirectionField && aggregate == aggregateMean {
+			value = meanDirection(values)
+		}
+		v.Field(i).Set(reflect.ValueOf(reading{value: value, valid: true}))
+	}
+	return obs, nil
+}
+
+func (p *virtualProvider) local() bool { return true }
+
+var windDirectionField, _ = observationField("wind_direction")
+
+func aggregateValues(aggregate string, values []float64) float64 {
+	switch aggregate {
+	case aggregateMedian:
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		if n := len(sorted); n%2 == 0 {
+			return (sorted[n/2-1] + sorted[n/2]) / 2
+		}
+		return sorted[len(sorted)/2]
+	case aggregateMin, aggregateMax:
+		v := values[0]
+		for _, x := range values[1:] {
+			if aggregate == aggregateMin {
+				v = math.Min(v, x)
+			} else {
+				v = math.Max(v, x)
+			}
+		}
+		return v
+	}
+	var sum float64
+	for _, x := range values {
+		sum += x
+	}
+	return sum / float64(len(values))
+}
+
+// meanDirection averages compass directions in degrees, so that 350 and 10
+// average to 0 rather than 180.
+func meanDirection(degrees []float64) float64 {
+	var x, y float64
+	for _, d := range degrees {
+		x += math.Cos(d * math.Pi / 180)
+		y += math.Sin(d * math.Pi / 180)
+	}
+	// Rounded, so that a rounding error just below 0 isn't 360.
+	d := math.Round(math.Atan2(y, x)*180/math.Pi*10) / 10
+	return math.Mod(d+360, 360)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type weatherComResponse struct {
+	Observations []struct {
+		StationID      string  `json:"stationID"`
+		Epoch          reading `json:"epoch"`
+		Lat            reading `json:"lat"`
+		Lon            reading `json:"lon"`
+		Humidity       reading `json:"humidity"`
+		WindDir        reading `json:"winddir"`
+		UV             reading `json:"uv"`
+		SolarRadiation reading `json:"solarRadiation"`
+		Metric         struct {
+			Temp        reading `json:"temp"`
+			HeatIndex   reading `json:"heatIndex"`
+			WindChill   reading `json:"windChill"`
+			DewPoint    reading `json:"dewpt"`
+			WindSpeed   reading `json:"windSpeed"`
+			WindGust    reading `json:"windGust"`
+			Pressure    reading `json:"pressure"`
+			PrecipTotal reading `json:"precipTotal"`
+		} `json:"metric"`
+	} `json:"observations"`
+}
+
+// weatherCom fetches observations from the weather.com PWS API, which
+// replaced the original Weather Underground API.
+type weatherCom struct {
+	httpClient *http.Client
+	apiKey     string
+	baseURL    string
+	limiter    *apiLimiter
+}
+
+func newWeatherCom(httpClient *http.Client, opts providerOptions) *weatherCom {
+	baseURL := opts.baseURL
+	if baseURL == "" {
+		baseURL = "https://api.weather.com"
+	}
+	return &weatherCom{httpClient, opts.apiKey, strings.TrimSuffix(baseURL, "/"), opts.limiter}
+}
+
+func (w *weatherCom) Name() string { return "weathercom" }
+
+func (w *weatherCom) Observe(ctx context.Context, stationID string) (Observation, error) {
+	q := url.Values{
+		"stationId":        {stationID},
+		"apiKey":           {w.apiKey},
+		"format":           {"json"},
+		"units":            {"m"},
+		"numericPrecision": {"decimal"},
+	}
+	if err := w.limiter.wait(ctx); err != nil {
+		return Observation{}, err
+	}
+	return get(ctx, w.httpClient, w.baseURL+"/v2/pws/observations/current?"+q.Encode(), stationID, parseWeatherCom)
+}
+
+// parseWeatherCom decodes a weather.com PWS current observations response.
+func parseWeatherCom(r io.Reader) (Observation, error) {
+	var data weatherComResponse
+	err := decodeJSON(r, &data)
+	if _, partial := err.(schemaError); err != nil && !partial {
+		return Observation{}, err
+	}
+	if len(data.Observations) == 0 {
+		return Observation{}, fmt.Errorf("no observations in response")
+	}
+	obs := data.Observations[0]
+	// The API reports both; wind chill only differs from the temperature
+	// when it's cold, and heat index when it's warm.
+	feelsLike := obs.Metric.HeatIndex
+	if obs.Metric.Temp.valid && obs.Metric.Temp.value <= 10 {
+		feelsLike = obs.Metric.WindChill
+	}
+	return Observation{
+		StationID:     obs.StationID,
+		ObservedAt:    epochTime(obs.Epoch),
+		Latitude:      obs.Lat,
+		Longitude:     obs.Lon,
+		Temperature:   obs.Metric.Temp,
+		FeelsLike:     feelsLike,
+		DewPoint:      obs.Metric.DewPoint,
+		Humidity:      obs.Humidity,
+		WindDirection: obs.WindDir,
+		WindSpeed:     obs.Metric.WindSpeed,
+		PrecipToday:   obs.Metric.PrecipTotal,
+		Pressure:      obs.Metric.Pressure,
+
+		WindGust:       obs.Metric.WindGust,
+		HeatIndex:      obs.Metric.HeatIndex,
+		WindChill:      obs.Metric.WindChill,
+		UV:             obs.UV,
+		SolarRadiation: obs.SolarRadiation,
+	}, err
+}
+
+type weatherComNearResponse struct {
+	Location struct {
+		StationID  []string  `json:"stationId"`
+		DistanceKm []reading `json:"distanceKm"`
+	} `json:"location"`
+}
+
+func (w *weatherCom) Nearby(ctx context.Context, lat float64, lon float64) ([]nearbyStation, error) {
+	q := url.Values{
+		"geocode": {fmt.Sprintf("%g,%g", lat, lon)},
+		"product": {"pws"},
+		"format":  {"json"},
+		"apiKey":  {w.apiKey},
+	}
+	if err := w.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	var stations []nearbyStation
+	err := getJSON(ctx, w.httpClient, w.baseURL+"/v3/location/near?"+q.Encode(), func(r io.Reader) error {
+		var data weatherComNearResponse
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+		loc := data.Location
+		if len(loc.DistanceKm) != len(loc.StationID) {
+			return fmt.Errorf("mismatched station and distance lists in response")
+		}
+		for i, id := range loc.StationID {
+			stations = append(stations, nearbyStation{id, loc.DistanceKm[i].value})
+		}
+		return nil
+	})
+	return stations, err
+}
+
+type weatherComHistoryResponse struct {
+	Observations []struct {
+		StationID          string  `json:"stationID"`
+		Epoch              reading `json:"epoch"`
+		Lat                reading `json:"lat"`
+		Lon                reading `json:"lon"`
+		HumidityAvg        reading `json:"humidityAvg"`
+		WindDirAvg         reading `json:"winddirAvg"`
+		UVHigh             reading `json:"uvHigh"`
+		SolarRadiationHigh reading `json:"solarRadiationHigh"`
+		Metric             struct {
+			TempAvg      reading `json:"tempAvg"`
+			DewPointAvg  reading `json:"dewptAvg"`
+			WindSpeedAvg reading `json:"windspeedAvg"`
+			WindGustHigh reading `json:"windgustHigh"`
+			HeatIndexAvg reading `json:"heatindexAvg"`
+			WindChillAvg reading `json:"windchillAvg"`
+			PressureMax  reading `json:"pressureMax"`
+			PrecipRate   reading `json:"precipRate"`
+			PrecipTotal  reading `json:"precipTotal"`
+		} `json:"metric"`
+	} `json:"observations"`
+}
+
+// History returns the observations of the station on day, which are
+// summaries of every few minutes.
+func (w *weatherCom) History(ctx context.Context, stationID string, day time.Time) ([]Observation, error) {
+	q := url.Values{
+		"stationId":        {stationID},
+		"apiKey":           {w.apiKey},
+		"format":           {"json"},
+		"units":            {"m"},
+		"numericPrecision": {"decimal"},
+		"date":             {day.Format("20060102")},
+	}
+	if err := w.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	var history []Observation
+	err := getJSON(ctx, w.httpClient, w.baseURL+"/v2/pws/history/all?"+q.Encode(), func(r io.Reader) error {
+		var data weatherComHistoryResponse
+		err := decodeJSON(r, &data)
+		if _, partial := err.(schemaError); err != nil && !partial {
+			return err
+		} else if partial {
+			slog.Warn("History doesn't match the expected schema, using what could be parsed", "station", stationID, "err", err)
+		}
+		for _, obs := range data.Observations {
+			history = append(history, Observation{
+				StationID:     stationID,
+				ObservedAt:    epochTime(obs.Epoch),
+				Latitude:      obs.Lat,
+				Longitude:     obs.Lon,
+				Temperature:   obs.Metric.TempAvg,
+				DewPoint:      obs.Metric.DewPointAvg,
+				Humidity:      obs.HumidityAvg,
+				WindDirection: obs.WindDirAvg,
+				WindSpeed:     obs.Metric.WindSpeedAvg,
+				PrecipToday:   obs.Metric.PrecipTotal,
+				Pressure:      obs.Metric.PressureMax,
+
+				WindGust:       obs.Metric.WindGustHigh,
+				HeatIndex:      obs.Metric.HeatIndexAvg,
+				WindChill:      obs.Metric.WindChillAvg,
+				UV:             obs.UVHigh,
+				SolarRadiation: obs.SolarRadiationHigh,
+				PrecipRate:     obs.Metric.PrecipRate,
+			})
+		}
+		return nil
+	})
+	return history, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// webhookConfig is a webhook in the config file. Header values are Go
+// templates with {{.StationID}} and {{env "NAME"}}, so that secrets can be
+// kept out of the file. Format is json, the default, or senml.
+type webhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Retries *int              `yaml:"retries"`
+	Format  string            `yaml:"format"`
+}
+
+// webhookPayload is the JSON body posted for each observation.
+type webhookPayload struct {
+	StationID string             `json:"station_id"`
+	Time      time.Time          `json:"time"`
+	Values    map[string]float64 `json:"values"`
+}
+
+type webhookHeaderData struct {
+	StationID string
+}
+
+// webhookSink posts every observation as JSON to a URL, retrying failed
+// requests and 5xx responses until the deadline of the write.
+type webhookSink struct {
+	httpClient *http.Client
+	url        string
+	headers    map[string]*template.Template
+	retries    int
+	retryDelay time.Duration
+
+	// senml, if set, posts SenML packs with the units in it.
+	senml map[string]sensor
+}
+
+// newWebhookSink returns a sink for c. info names the properties and their
+// units in SenML packs.
+func newWebhookSink(c webhookConfig, timeout time.Duration, info map[string]sensor) (*webhookSink, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("webhook without url")
+	}
+	s := &webhookSink{
+		httpClient: &http.Client{Timeout: timeout},
+		url:        c.URL,
+		headers:    map[string]*template.Template{},
+		retries:    2,
+		retryDelay: time.Second,
+	}
+	if c.Retries != nil {
+		s.retries = *c.Retries
+	}
+	switch c.Format {
+	case "", "json":
+	case formatSenML:
+		s.senml = info
+	default:
+		return nil, fmt.Errorf("%s: unknown format %q, expected json or senml", c.URL, c.Format)
+	}
+	funcs := template.FuncMap{"env": os.Getenv}
+	for name, value := range c.Headers {
+		tmpl, err := template.New(name).Funcs(funcs).Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: header %s: %v", c.URL, name, err)
+		}
+		s.headers[name] = tmpl
+	}
+	return s, nil
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Write(ctx context.Context, stationID string, at time.Time, values map[string]float64) error {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if s.senml != nil {
+		body, err = senmlPack(stationID, at, values, s.senml)
+		contentType = "application/senml+json"
+	} else {
+		body, err = json.Marshal(webhookPayload{stationID, at.UTC(), values})
+	}
+	if err != nil {
+		return err
+	}
+	headers := http.Header{"Content-Type": {contentType}}
+	names := make([]string, 0, len(s.headers))
+	for name := range s.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var b strings.Builder
+		if err := s.headers[name].Execute(&b, webhookHeaderData{stationID}); err != nil {
+			return fmt.Errorf("header %s: %v", name, err)
+		}
+		headers.Set(name, b.String())
+	}
+
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body, headers)
+		if err == nil || !retry || attempt >= s.retries {
+			return err
+		}
+		// Retrying stops at the deadline of ctx, which is the station's
+		// next fetch, rather than sleep past it.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		if !sleep(ctx, delay) {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// post sends one request, and reports whether it is worth retrying if it
+// failed.
+func (s *webhookSink) post(ctx context.Context, body []byte, headers http.Header) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = headers.Clone()
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return false, nil
+}
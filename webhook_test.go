@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	retries := 5
+	s, err := newWebhookSink(webhookConfig{URL: srv.URL, Retries: &retries}, time.Second, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.retryDelay = 10 * time.Millisecond
+
+	t.Run("until the retries run out", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		if err := s.Write(context.Background(), "KX1", time.Now(), map[string]float64{"temperature_degrees": 21.5}); err == nil {
+			t.Fatal("write succeeded")
+		}
+		if got := atomic.LoadInt32(&requests); got != 6 {
+			t.Errorf("%d requests, want 6", got)
+		}
+	})
+	t.Run("until the deadline", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		// The delays are 10, 20 and 40ms, so the third retry would pass
+		// the deadline.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := s.Write(ctx, "KX1", time.Now(), nil); err == nil {
+			t.Fatal("write succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+			t.Errorf("retried for %v, past the deadline", elapsed)
+		}
+		if got := atomic.LoadInt32(&requests); got != 3 {
+			t.Errorf("%d requests, want 3", got)
+		}
+	})
+	t.Run("until cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		s := *s
+		s.retryDelay = time.Hour
+		done := make(chan error)
+		go func() { done <- s.Write(ctx, "KX1", time.Now(), nil) }()
+		cancel()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("write succeeded")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("backoff wasn't cancelled")
+		}
+	})
+}
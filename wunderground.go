@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type response struct {
+	CurrentObservation struct {
+		ObservationLocation struct {
+			Latitude  reading `json:"latitude"`
+			Longitude reading `json:"longitude"`
+		} `json:"observation_location"`
+		StationID         string  `json:"station_id"`
+		ObservationEpoch  reading `json:"observation_epoch"`
+		TempC             reading `json:"temp_c"`
+		RelativeHumidity  reading `json:"relative_humidity"`
+		WindDegrees       reading `json:"wind_degrees"`
+		WindKph           reading `json:"wind_kph"`
+		FeelsLikeC        reading `json:"feelslike_c"`
+		DewPointC         reading `json:"dewpoint_c"`
+		PressureMb        reading `json:"pressure_mb"`
+		PrecipTodayMetric reading `json:"precip_today_metric"`
+		Precip1hrMetric   reading `json:"precip_1hr_metric"`
+		WindGustKph       reading `json:"wind_gust_kph"`
+		VisibilityKm      reading `json:"visibility_km"`
+		UV                reading `json:"UV"`
+		SolarRadiation    reading `json:"solarradiation"`
+	} `json:"current_observation"`
+}
+
+// wunderground fetches observations from the Weather Underground API.
+type wunderground struct {
+	httpClient *http.Client
+	apiKey     string
+	baseURL    string
+	limiter    *apiLimiter
+}
+
+func newWunderground(httpClient *http.Client, opts providerOptions) *wunderground {
+	baseURL := opts.baseURL
+	if baseURL == "" {
+		baseURL = "https://api.wunderground.com"
+	}
+	return &wunderground{httpClient, opts.apiKey, strings.TrimSuffix(baseURL, "/"), opts.limiter}
+}
+
+func (w *wunderground) Name() string { return "wunderground" }
+
+func (w *wunderground) Observe(ctx context.Context, stationID string) (Observation, error) {
+	url := fmt.Sprintf("%s/api/%s/conditions/q/pws:%s.json", w.baseURL, w.apiKey, stationID)
+	if err := w.limiter.wait(ctx); err != nil {
+		return Observation{}, err
+	}
+	return get(ctx, w.httpClient, url, stationID, parseObservation)
+}
+
+// parseObservation decodes a wunderground conditions response.
+func parseObservation(r io.Reader) (Observation, error) {
+	var data response
+	err := decodeJSON(r, &data)
+	if _, partial := err.(schemaError); err != nil && !partial {
+		return Observation{}, err
+	}
+	obs := data.CurrentObservation
+	return Observation{
+		StationID:     obs.StationID,
+		ObservedAt:    epochTime(obs.ObservationEpoch),
+		Latitude:      obs.ObservationLocation.Latitude,
+		Longitude:     obs.ObservationLocation.Longitude,
+		Temperature:   obs.TempC,
+		FeelsLike:     obs.FeelsLikeC,
+		DewPoint:      obs.DewPointC,
+		Humidity:      obs.RelativeHumidity,
+		WindDirection: obs.WindDegrees,
+		WindSpeed:     obs.WindKph,
+		PrecipToday:   obs.PrecipTodayMetric,
+		Pressure:      obs.PressureMb,
+
+		WindGust:       obs.WindGustKph,
+		Precip1hr:      obs.Precip1hrMetric,
+		Visibility:     obs.VisibilityKm,
+		UV:             obs.UV,
+		SolarRadiation: obs.SolarRadiation,
+	}, err
+}
+
+type forecastResponse struct {
+	Forecast struct {
+		SimpleForecast struct {
+			ForecastDay []struct {
+				Date struct {
+					Epoch reading `json:"epoch"`
+				} `json:"date"`
+				High struct {
+					Celsius reading `json:"celsius"`
+				} `json:"high"`
+				Low struct {
+					Celsius reading `json:"celsius"`
+				} `json:"low"`
+				Conditions string  `json:"conditions"`
+				Pop        reading `json:"pop"`
+				QPFAllDay  struct {
+					MM reading `json:"mm"`
+				} `json:"qpf_allday"`
+			} `json:"forecastday"`
+		} `json:"simpleforecast"`
+	} `json:"forecast"`
+}
+
+func (w *wunderground) Forecast(ctx context.Context, stationID string) (Forecast, error) {
+	url := fmt.Sprintf("%s/api/%s/forecast/q/pws:%s.json", w.baseURL, w.apiKey, stationID)
+	if err := w.limiter.wait(ctx); err != nil {
+		return Forecast{}, err
+	}
+	var forecast Forecast
+	err := getJSON(ctx, w.httpClient, url, func(r io.Reader) error {
+		var err error
+		forecast, err = parseForecast(r)
+		return err
+	})
+	return forecast, err
+}
+
+// parseForecast decodes a wunderground forecast response.
+func parseForecast(r io.Reader) (Forecast, error) {
+	var data forecastResponse
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return Forecast{}, fmt.Errorf("failed to decode JSON: %v", err)
+	}
+	var forecast Forecast
+	for _, day := range data.Forecast.SimpleForecast.ForecastDay {
+		forecast.Days = append(forecast.Days, ForecastDay{
+			Date:         time.Unix(int64(day.Date.Epoch.value), 0),
+			Conditions:   day.Conditions,
+			High:         day.High.Celsius,
+			Low:          day.Low.Celsius,
+			PrecipChance: day.Pop,
+			Precip:       day.QPFAllDay.MM,
+		})
+	}
+	if len(forecast.Days) == 0 {
+		return Forecast{}, fmt.Errorf("no forecast in response")
+	}
+	return forecast, nil
+}
+
+type alertsResponse struct {
+	Alerts []struct {
+		Type         string  `json:"type"`
+		Description  string  `json:"description"`
+		DateEpoch    reading `json:"date_epoch"`
+		ExpiresEpoch reading `json:"expires_epoch"`
+		Message      string  `json:"message"`
+		Phenomena    string  `json:"phenomena"`
+		Significance string  `json:"significance"`
+		// MeteoAlarm alerts for Europe report a level instead.
+		Level reading `json:"level_meteoalarm"`
+	} `json:"alerts"`
+}
+
+func (w *wunderground) Alerts(ctx context.Context, stationID string) ([]Alert, error) {
+	url := fmt.Sprintf("%s/api/%s/alerts/q/pws:%s.json", w.baseURL, w.apiKey, stationID)
+	if err := w.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	var alerts []Alert
+	err := getJSON(ctx, w.httpClient, url, func(r io.Reader) error {
+		var err error
+		alerts, err = parseAlerts(r)
+		return err
+	})
+	return alerts, err
+}
+
+// parseAlerts decodes a wunderground alerts response.
+func parseAlerts(r io.Reader) ([]Alert, error) {
+	var data alertsResponse
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %v", err)
+	}
+	var alerts []Alert
+	for _, a := range data.Alerts {
+		issued := time.Unix(int64(a.DateEpoch.value), 0).UTC()
+		alerts = append(alerts, Alert{
+			ID:          fmt.Sprintf("%s.%s.%d", a.Phenomena, a.Significance, issued.Unix()),
+			Type:        a.Type,
+			Description: a.Description,
+			Severity:    alertSeverity(a.Significance, a.Level),
+			Issued:      issued,
+			Expires:     time.Unix(int64(a.ExpiresEpoch.value), 0).UTC(),
+			Message:     strings.TrimSpace(a.Message),
+		})
+	}
+	return alerts, nil
+}
+
+type geolookupResponse struct {
+	Location struct {
+		NearbyWeatherStations struct {
+			PWS struct {
+				Station []struct {
+					ID         string  `json:"id"`
+					DistanceKm reading `json:"distance_km"`
+				} `json:"station"`
+			} `json:"pws"`
+		} `json:"nearby_weather_stations"`
+	} `json:"location"`
+}
+
+func (w *wunderground) Nearby(ctx context.Context, lat float64, lon float64) ([]nearbyStation, error) {
+	url := fmt.Sprintf("%s/api/%s/geolookup/q/%g,%g.json", w.baseURL, w.apiKey, lat, lon)
+	if err := w.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	var stations []nearbyStation
+	err := getJSON(ctx, w.httpClient, url, func(r io.Reader) error {
+		var data geolookupResponse
+		if err := json.NewDecoder(r).Decode(&data); err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+		for _, s := range data.Location.NearbyWeatherStations.PWS.Station {
+			stations = append(stations, nearbyStation{s.ID, s.DistanceKm.value})
+		}
+		return nil
+	})
+	return stations, err
+}
+
+// alertSeverity maps an NWS significance code, or a MeteoAlarm level, to one
+// of alertSeverities.
+func alertSeverity(significance string, level reading) string {
+	switch significance {
+	case "W":
+		return "warning"
+	case "A":
+		return "watch"
+	case "Y":
+		return "advisory"
+	case "S":
+		return "statement"
+	}
+	if level.valid {
+		switch {
+		case level.value >= 3:
+			return "warning"
+		case level.value >= 2:
+			return "watch"
+		case level.value >= 1:
+			return "advisory"
+		}
+	}
+	return "unknown"
+}